@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/miekg/pgo/conf"
+)
+
+// check parses and validates the config, and with --plan prints what pgod would do with it given the state in
+// --dir. It doesn't need root and doesn't touch docker, secret references are only checked for their syntax.
+func check(exec *ExecContext, w io.Writer) error {
+	doc, err := os.ReadFile(exec.ConfigSource)
+	if err != nil {
+		return fmt.Errorf("reading config: %v", err)
+	}
+	c, err := conf.ParseCheck(doc)
+	if err != nil {
+		return fmt.Errorf("parsing config: %v", err)
+	}
+	if errs := c.Check(); len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintln(w, err)
+		}
+		return fmt.Errorf("config %q has %d problem(s)", exec.ConfigSource, len(errs))
+	}
+	if !exec.Plan {
+		fmt.Fprintf(w, "Config %q is OK, with %d services\n", exec.ConfigSource, len(c.Services))
+		return nil
+	}
+
+	p, err := c.Plan(exec.Dir)
+	if err != nil {
+		return err
+	}
+	for _, l := range []struct {
+		what  string
+		names []string
+	}{
+		{"create users", p.Users},
+		{"clone", p.Clone},
+		{"restart", p.Restart},
+		{"keep down", p.Down},
+		{"remove (stale)", p.Stale},
+	} {
+		if len(l.names) > 0 {
+			fmt.Fprintf(w, "%-15s %s\n", l.what+":", strings.Join(l.names, " "))
+		}
+	}
+	return nil
+}
@@ -15,7 +15,8 @@ import (
 
 	"github.com/gliderlabs/ssh"
 	"github.com/miekg/pgo/conf"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/miekg/pgo/logfile"
+	"github.com/miekg/pgo/tracing"
 	flag "github.com/spf13/pflag"
 	"go.science.ru.nl/log"
 )
@@ -24,8 +25,12 @@ type ExecContext struct {
 	ConfigSource string
 	SAddr        string
 	MAddr        string
+	Trace        string
+	LogFormat    string
 	Debug        bool
 	Restart      bool
+	Check        bool
+	Plan         bool
 	Dir          string
 	DataDir      string
 	Duration     time.Duration
@@ -40,10 +45,14 @@ func (exec *ExecContext) RegisterFlags(fs *flag.FlagSet) {
 	fs.StringVarP(&exec.ConfigSource, "config", "c", "/etc/pgo.toml", "config file to read")
 	fs.StringVarP(&exec.SAddr, "ssh", "s", ":2222", "address for SSH to listen on")
 	fs.StringVarP(&exec.MAddr, "metric", "m", ":9112", "address for Prometheus metrics to listen on")
+	fs.StringVarP(&exec.Trace, "trace", "", "", "OTLP/HTTP endpoint to send traces to, i.e. http://localhost:4318")
+	fs.StringVarP(&exec.LogFormat, "log-format", "", logfile.JSON, "format of the per service log files: json or logfmt")
 	fs.StringVarP(&exec.Dir, "dir", "d", "/var/lib/pgo", "directory to check out the git repositories")
 	fs.StringVarP(&exec.DataDir, "datadir", "", "/data", "directory to mount NFS shares")
 	fs.BoolVarP(&exec.Debug, "debug", "", false, "enable debug logging")
-	fs.BoolVarP(&exec.Restart, "restart", "", true, "send SIGHUP when config changes")
+	fs.BoolVarP(&exec.Restart, "restart", "", true, "reload the config when it changes")
+	fs.BoolVarP(&exec.Check, "check", "", false, "check the config and exit")
+	fs.BoolVarP(&exec.Plan, "plan", "", false, "check the config, show what would be done with it and exit")
 	fs.BoolVarP(&exec.Version, "version", "v", false, "show version and exit")
 	fs.DurationVarP(&exec.Duration, "duration", "t", 5*time.Minute, "default duration between pulls")
 }
@@ -52,7 +61,6 @@ var (
 	ErrNotRoot  = errors.New("not root")
 	ErrNoConfig = errors.New("-c flag is mandatory")
 	ErrNoDir    = errors.New("-d flag is mandatory")
-	ErrHUP      = errors.New("hangup requested")
 )
 
 func serveSSH(exec *ExecContext, controllerWG, workerWG *sync.WaitGroup, sshHandler ssh.Handler) error {
@@ -84,6 +92,9 @@ func serveSSH(exec *ExecContext, controllerWG, workerWG *sync.WaitGroup, sshHand
 }
 
 func run(exec *ExecContext) error {
+	if exec.Check || exec.Plan {
+		return check(exec, os.Stdout)
+	}
 	if os.Geteuid() != 0 {
 		return ErrNotRoot
 	}
@@ -102,24 +113,21 @@ func run(exec *ExecContext) error {
 	if path.Clean(exec.Dir) == "/" {
 		return fmt.Errorf("--dir can not be /")
 	}
-
-	doc, err := os.ReadFile(exec.ConfigSource)
-	if err != nil {
-		return fmt.Errorf("reading config: %v", err)
+	if exec.LogFormat != logfile.JSON && exec.LogFormat != logfile.Logfmt {
+		return fmt.Errorf("--log-format must be %q or %q", logfile.JSON, logfile.Logfmt)
 	}
-	c, err := conf.Parse(doc)
+	logfile.Format = exec.LogFormat
+
+	c, err := loadConfig(exec.ConfigSource)
 	if err != nil {
-		return fmt.Errorf("parsing config: %v", err)
-	}
-	for _, s := range c.Services {
-		if err := s.InitGitAndCompose(exec.Dir, exec.DataDir); err != nil {
-			return err
-		}
+		return err
 	}
 
-	if err := conf.Stale(c.Services, exec.Dir); err != nil {
-		return fmt.Errorf("error while trying to clean up stale services: %s", err)
+	shutdown, err := tracing.Setup(exec.Trace, version)
+	if err != nil {
+		return fmt.Errorf("setting up tracing: %v", err)
 	}
+	defer shutdown(context.TODO())
 
 	ctx, cancel := context.WithCancel(context.TODO())
 	defer cancel()
@@ -127,70 +135,96 @@ func run(exec *ExecContext) error {
 	var workerWG, controllerWG sync.WaitGroup
 	defer controllerWG.Wait()
 
-	// start a fake worker thread, that in the case of no actual threads, will call done on the workerWG (and more
-	// importantly will now have seen at least one Add(1)). This will make sure the serveMetrics and serveSSH return
-	// correctly on receiving ^C.
+	// The tracker's worker thread waits for all services' trackers. It also makes sure workerWG has seen at least
+	// one Add(1), so serveMetrics and serveSSH return correctly on receiving ^C, even without services.
+	t := conf.NewTracker(exec.Dir, exec.DataDir, exec.Duration)
 	workerWG.Add(1)
 	go func() {
 		defer workerWG.Done()
-		select {
-		case <-ctx.Done():
-			return
-		}
+		<-ctx.Done()
+		t.Wait()
 	}()
-
-	for _, s := range c.Services {
-		log.Infof("[%s]: Service %q with upstream %q", s.Name, s.Name, s.Repository)
-		workerWG.Add(1)
-		go func(s1 *conf.Service) {
-			defer workerWG.Done()
-			s1.Track(ctx, exec.Duration)
-		}(s)
+	if err := t.Reload(ctx, c); err != nil {
+		return err
 	}
 
-	http.Handle("/metrics", promhttp.Handler())
 	go func() {
-		log.Fatal(http.ListenAndServe(exec.MAddr, nil))
+		log.Fatal(http.ListenAndServe(exec.MAddr, newMux(t)))
 	}()
-	log.Infof("[-] Launched server on port %s (prometheus)", exec.MAddr)
+	log.Infof("[-] Launched server on port %s (prometheus and status API)", exec.MAddr)
 
-	sshHandler := newRouter(c)
+	sshHandler := newRouter(t)
 	if err := serveSSH(exec, &controllerWG, &workerWG, sshHandler); err != nil {
 		return err
 	}
 	log.Infof("[-] Launched server on port %s (ssh) with %d services tracked", exec.SAddr, len(c.Services))
 
+	// reload reparses the config and switches to it, services that didn't change keep running.
+	reload := func() {
+		c, err := loadConfig(exec.ConfigSource)
+		if err != nil {
+			log.Errorf("Failed to reload, keeping the current config: %v", err)
+			return
+		}
+		if err := t.Reload(ctx, c); err != nil {
+			log.Errorf("Failed to reload: %v", err)
+			return
+		}
+		log.Infof("[-] Reloaded config with %d services tracked", len(t.Config().Services))
+	}
+
+	// SIGINT and SIGTERM are handled apart from SIGHUP, so a reload that waits for a deploy doesn't block them.
 	done := make(chan os.Signal, 1)
-	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	if exec.Restart {
 		workerWG.Add(1)
 		go func() {
 			defer workerWG.Done()
-			conf.Track(ctx, exec.ConfigSource, done)
+			files := func() []string { return append([]string{exec.ConfigSource}, t.Config().Sources()...) }
+			conf.Track(ctx, files, reload)
 		}()
 	}
-	hup := make(chan struct{})
 	workerWG.Add(1)
 	go func() {
 		defer workerWG.Done()
 		select {
-		case s := <-done:
+		case <-done:
 			cancel()
-			if s == syscall.SIGHUP {
-				close(hup)
-			}
 		case <-ctx.Done():
 		}
 	}()
+	workerWG.Add(1)
+	go func() {
+		defer workerWG.Done()
+		for {
+			select {
+			case <-hup:
+				log.Info("SIGHUP seen, reloading")
+				reload()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 	workerWG.Wait()
-	select {
-	case <-hup:
-		return ErrHUP
-	default:
-	}
 	return nil
 }
 
+// loadConfig reads and parses the config file.
+func loadConfig(file string) (*conf.Config, error) {
+	doc, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %v", err)
+	}
+	c, err := conf.Parse(doc)
+	if err != nil {
+		return nil, fmt.Errorf("parsing config: %v", err)
+	}
+	return c, nil
+}
+
 var version = "n/a"
 
 func main() {
@@ -201,13 +235,7 @@ func main() {
 		fmt.Println(version)
 		os.Exit(0)
 	}
-	err := run(&exec)
-	switch {
-	case err == nil:
-	case errors.Is(err, ErrHUP):
-		// on HUP exit with exit status 2, so systemd can restart us (Restart=OnFailure)
-		os.Exit(2)
-	default:
+	if err := run(&exec); err != nil {
 		log.Fatal(err)
 	}
 }
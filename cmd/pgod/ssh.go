@@ -1,19 +1,22 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gliderlabs/ssh"
 	"github.com/miekg/pgo/conf"
 	"github.com/miekg/pgo/osutil"
+	"github.com/miekg/pgo/tracing"
 	"go.science.ru.nl/log"
 )
 
 // pgoctl machine dhz//status
-func newRouter(c *conf.Config) ssh.Handler {
+func newRouter(t *conf.Tracker) ssh.Handler {
 	return func(ses ssh.Session) {
 		pub := ses.PublicKey()
 		if pub == nil {
@@ -30,6 +33,7 @@ func newRouter(c *conf.Config) ssh.Handler {
 			return
 		}
 		var s *conf.Service
+		c := t.Config()
 		for i := range c.Services {
 			if c.Services[i].Name == name {
 				s = c.Services[i]
@@ -67,39 +71,62 @@ func newRouter(c *conf.Config) ssh.Handler {
 
 		}
 		log.Infof("[%s]: Routing for user %q, running %q %v", name, ses.User(), command, args)
-		out, err := route(s, args)
+		ctx, span := tracing.Route(ses.Context(), s.Name, command)
+		out, err := route(ctx, s, args)
+		tracing.Exit(span, err)
 		exitSession(ses, out, err)
 		return
 	}
 }
 
-var routes = map[string]func(s *conf.Service, args []string) ([]byte, error){
-	"up":      func(c *conf.Service, args []string) ([]byte, error) { return c.Compose.Up(args) },
-	"down":    func(c *conf.Service, args []string) ([]byte, error) { return c.Compose.Down(args) },
-	"stop":    func(c *conf.Service, args []string) ([]byte, error) { return c.Compose.Stop(args) },
-	"start":   func(c *conf.Service, args []string) ([]byte, error) { return c.Compose.Start(args) },
-	"restart": func(c *conf.Service, args []string) ([]byte, error) { return c.Compose.ReStart(args) },
-	"ps":      func(c *conf.Service, args []string) ([]byte, error) { return c.Compose.Ps(args) },
-	"pull":    func(c *conf.Service, args []string) ([]byte, error) { return c.Compose.Pull(args) },
-	"exec":    func(c *conf.Service, args []string) ([]byte, error) { return c.Compose.Exec(args) },
-	"load":    func(c *conf.Service, args []string) ([]byte, error) { return c.Compose.Load(args) },
-
-	"logs": func(c *conf.Service, args []string) ([]byte, error) {
+// routes are the commands that can be run for a service. Ctx carries the span of the route, see tracing.Route.
+var routes = map[string]func(ctx context.Context, s *conf.Service, args []string) ([]byte, error){
+	"up": func(ctx context.Context, c *conf.Service, args []string) ([]byte, error) {
+		return c.Compose.Up(ctx, args)
+	},
+	"down": func(ctx context.Context, c *conf.Service, args []string) ([]byte, error) {
+		return c.Compose.Down(ctx, args)
+	},
+	"stop": func(ctx context.Context, c *conf.Service, args []string) ([]byte, error) {
+		return c.Compose.Stop(ctx, args)
+	},
+	"start": func(ctx context.Context, c *conf.Service, args []string) ([]byte, error) {
+		return c.Compose.Start(ctx, args)
+	},
+	"restart": func(ctx context.Context, c *conf.Service, args []string) ([]byte, error) {
+		return c.Compose.ReStart(ctx, args)
+	},
+	"ps": func(ctx context.Context, c *conf.Service, args []string) ([]byte, error) {
+		out, err := c.Compose.Ps(ctx, args)
+		if c.CrashLooping() {
+			out = append([]byte("Warning: service is crash looping, its containers keep dying\n"), out...)
+		}
+		return out, err
+	},
+	"pull": func(ctx context.Context, c *conf.Service, args []string) ([]byte, error) {
+		return c.Compose.Pull(ctx, args)
+	},
+	"exec": func(ctx context.Context, c *conf.Service, args []string) ([]byte, error) {
+		return c.Compose.Exec(ctx, args)
+	},
+	"load": func(ctx context.Context, c *conf.Service, args []string) ([]byte, error) { return c.Compose.Load(args) },
+
+	"logs": func(ctx context.Context, c *conf.Service, args []string) ([]byte, error) {
 		for i := range args {
 			if args[i] == "-f" || args[i] == "--follow" {
 				return nil, fmt.Errorf("logs: following logs is not possible")
 			}
 		}
-		return c.Compose.Logs(args)
+		return c.Compose.Logs(ctx, args)
 	},
 
-	"git": func(c *conf.Service, args []string) ([]byte, error) {
+	"git": func(ctx context.Context, c *conf.Service, args []string) ([]byte, error) {
 		if len(args) == 0 {
 			return nil, fmt.Errorf("expected git command, got nothing")
 		}
 		switch args[0] {
 		case "pull":
-			_, err := c.Git.Pull(nil)
+			_, err := c.Git.Pull(ctx, nil)
 			return nil, err
 		case "hash":
 			hash := c.Git.Hash()
@@ -109,7 +136,7 @@ var routes = map[string]func(s *conf.Service, args []string) ([]byte, error){
 		}
 	},
 
-	"journal": func(c *conf.Service, args []string) ([]byte, error) {
+	"journal": func(ctx context.Context, c *conf.Service, args []string) ([]byte, error) {
 		return nil, fmt.Errorf("disabled")
 		/*
 			for i := range args {
@@ -131,7 +158,22 @@ var routes = map[string]func(s *conf.Service, args []string) ([]byte, error){
 		*/
 	},
 
-	"ping": func(c *conf.Service, _ []string) ([]byte, error) {
+	"pgolog": func(ctx context.Context, c *conf.Service, args []string) ([]byte, error) {
+		n := 100
+		if len(args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil || n <= 0 {
+				return nil, fmt.Errorf("pgolog: expected number of lines, got %q", args[0])
+			}
+		}
+		return c.Log(n)
+	},
+
+	"recipient": func(_ context.Context, c *conf.Service, _ []string) ([]byte, error) {
+		return []byte(c.Recipient() + "\n"), nil
+	},
+
+	"ping": func(_ context.Context, c *conf.Service, _ []string) ([]byte, error) {
 		return []byte("pong! - " + osutil.Hostname() + "\n"), nil
 	},
 }
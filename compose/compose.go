@@ -1,13 +1,17 @@
 package compose
 
 import (
+	"bytes"
 	"context"
-	"os/exec"
+	"fmt"
 	"sync"
+	"text/tabwriter"
+	"time"
 
+	"github.com/miekg/pgo/logfile"
 	"github.com/miekg/pgo/metric"
 	"github.com/miekg/pgo/osutil"
-	"go.science.ru.nl/log"
+	"github.com/miekg/pgo/tracing"
 )
 
 type Compose struct {
@@ -20,8 +24,12 @@ type Compose struct {
 	file       string   // alternate compose file name
 	mount      string   // optional mount
 	registries []string // private docker registries
+	runner     Runner   // how to run docker compose and query docker
 
-	pullLock sync.RWMutex // protects docker pull and hence docker login
+	cgroupParent string                       // cgroup_parent for all containers, see SetCgroupParent
+	labels       map[string]map[string]string // extra labels per compose service, see SetLabels
+	targets      []string                     // targets of the reverse proxy routes, see SetTargets
+	dockerConfig string                       // DOCKER_CONFIG directory holding the registry auths, see SetDockerConfig
 }
 
 // New returns a pointer to an intialized Compose.
@@ -37,101 +45,154 @@ func New(name, user, directory, file, datadirectory string, registries []string,
 		file:       file,
 		env:        env,
 		mount:      mount,
+		runner:     defaultRunner,
 	}
 	return c
 }
 
-func (c *Compose) run(args ...string) ([]byte, error) {
-	ctx := context.TODO()
-	if c.file != "" {
-		args = append([]string{"--file", c.file}, args...)
-	}
-	args = append([]string{"compose"}, args...)
-	cmd := exec.CommandContext(ctx, "docker", args...)
+var defaultRunner Runner = NewCLI(osutil.Docker, "")
 
-	if _, err := exec.LookPath("docker-compose"); err == nil {
-		// docker-compose is the installed command, use that and strip compose out of args
-		args = args[1:]
-		cmd = exec.CommandContext(ctx, "docker-compose", args...)
-	}
+// SetRunner sets the Runner used for c, the default is a CLI running docker, using the default docker socket.
+func (c *Compose) SetRunner(r Runner) { c.runner = r }
 
-	if err := osutil.RunAs(cmd, c.user); err != nil {
-		return nil, err
+// run runs docker compose with args, ctx carries the span the command is traced under, see tracing.Command.
+func (c *Compose) run(ctx context.Context, args ...string) ([]byte, error) {
+	sub := args[0]
+	over, err := c.overrideArgs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to write cgroup override: %s", err)
+	}
+	switch {
+	case over != nil:
+		args = append(over, args...)
+	case c.file != "":
+		args = append([]string{"--file", c.file}, args...)
 	}
-	cmd.Dir = c.dir
-	cmd.Env = append(cmd.Env, c.env...)
-
-	metric.CmdCount.WithLabelValues(c.name, "compose", args[0]).Inc()
 
-	log.Debugf("[%s]: running in %q as %q %v (env: %v)", c.name, cmd.Dir, c.user, cmd.Args, osutil.EnvVars(c.env))
+	metric.CmdCount.WithLabelValues(c.name, "compose", sub).Inc()
+	span := tracing.Command(ctx, c.name, "compose "+sub)
+	start := time.Now()
 
-	out, err := cmd.CombinedOutput()
-	if len(out) > 0 {
-		log.Debugf("[%s]: %s", c.name, string(out))
-	}
+	out, err := c.runner.Compose(c, args...)
 	if err != nil {
-		metric.CmdErrorCount.WithLabelValues(c.name, "compose", args[0]).Inc()
+		metric.CmdErrorCount.WithLabelValues(c.name, "compose", sub).Inc()
 	}
-
+	tracing.Exit(span, err)
+	logfile.Command(c.name, "compose "+sub, start, out, err)
 	return out, err
 }
 
-func (c *Compose) Down(args []string) ([]byte, error) {
-	return c.run(append([]string{"down"}, args...)...)
+func (c *Compose) Down(ctx context.Context, args []string) ([]byte, error) {
+	return c.run(ctx, append([]string{"down"}, args...)...)
+}
+func (c *Compose) Stop(ctx context.Context, args []string) ([]byte, error) {
+	return c.run(ctx, append([]string{"stop"}, args...)...)
+}
+func (c *Compose) Up(ctx context.Context, args []string) ([]byte, error) {
+	return c.run(ctx, append([]string{"up", "-d"}, args...)...)
+}
+func (c *Compose) Start(ctx context.Context, args []string) ([]byte, error) {
+	return c.run(ctx, append([]string{"start"}, args...)...)
+}
+
+// ReStart starts the stopped containers of the compose services in args again, like Start, it's the restart
+// route of pgoctl(1). It doesn't touch running containers, see RestartContainers for that.
+func (c *Compose) ReStart(ctx context.Context, args []string) ([]byte, error) {
+	return c.run(ctx, append([]string{"start"}, args...)...)
+}
+
+// RestartContainers restarts the (running) containers of the compose services in args, this is used to remediate
+// unhealthy ones. Not to be confused with ReStart.
+func (c *Compose) RestartContainers(ctx context.Context, args []string) ([]byte, error) {
+	return c.run(ctx, append([]string{"restart"}, args...)...)
 }
-func (c *Compose) Stop(args []string) ([]byte, error) {
-	return c.run(append([]string{"stop"}, args...)...)
+func (c *Compose) Pull(ctx context.Context, args []string) ([]byte, error) {
+	return c.run(ctx, append([]string{"pull"}, args...)...)
 }
-func (c *Compose) Up(args []string) ([]byte, error) {
-	// On compose up, I've seen pulls, as well, so take the lock...?
-	if len(c.registries) > 0 {
-		c.pullLock.Lock()
-		defer c.pullLock.Unlock()
+func (c *Compose) Logs(ctx context.Context, args []string) ([]byte, error) {
+	return c.run(ctx, append([]string{"logs"}, args...)...)
+}
+
+// Ps returns the status of the containers. Without args this is a table made from the Docker Engine API,
+// otherwise docker compose ps is run with args.
+func (c *Compose) Ps(ctx context.Context, args []string) ([]byte, error) {
+	if len(args) > 0 {
+		return c.run(ctx, append([]string{"ps"}, args...)...)
 	}
-	err := c.Login("login")
+	cs, err := c.Containers()
 	if err != nil {
 		return nil, err
 	}
-	log.Infof("[%s]: %s", c.name, "Successfully logged into docker registry")
-	if out, err := c.run(append([]string{"up", "-d"}, args...)...); err != nil {
-		c.Login("logout")
-		return out, err
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tIMAGE\tSERVICE\tCREATED\tSTATUS")
+	for _, ct := range cs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", ct.Name, ct.Image, ct.Service, ct.Created.Format("2006-01-02 15:04:05"), ct.Status)
 	}
-	err = c.Login("logout")
-	return nil, err
-}
-func (c *Compose) Start(args []string) ([]byte, error) {
-	return c.run(append([]string{"start"}, args...)...)
+	w.Flush()
+	return buf.Bytes(), nil
 }
-func (c *Compose) ReStart(args []string) ([]byte, error) {
-	return c.run(append([]string{"start"}, args...)...)
+
+// Project returns the name of the compose project, this is the name of the service.
+func (c *Compose) Project() string { return c.name }
+
+// Containers returns all containers of the compose project.
+func (c *Compose) Containers() ([]Container, error) { return c.runner.Containers(c.Project()) }
+
+// Inspect returns the container with id.
+func (c *Compose) Inspect(id string) (*Container, error) { return c.runner.Inspect(id) }
+
+// ContainerStats is the resource usage and state of a container of the compose project.
+type ContainerStats struct {
+	Container
+	Stats // zero when the container isn't running
 }
-func (c *Compose) Pull(args []string) ([]byte, error) {
-	// Locking is only needed for private registries.
-	if len(c.registries) > 0 {
-		c.pullLock.Lock()
-		defer c.pullLock.Unlock()
-	}
-	err := c.Login("login")
+
+// Stats returns the resource usage, restart count and health of all containers of the compose project. The
+// containers are queried in parallel.
+func (c *Compose) Stats() ([]ContainerStats, error) {
+	cs, err := c.Containers()
 	if err != nil {
 		return nil, err
 	}
-	log.Infof("[%s]: %s", c.name, "Successfully logged into docker registry")
-	if out, err := c.run(append([]string{"pull"}, args...)...); err != nil {
-		c.Login("logout")
-		return out, err
+	all := make([]*ContainerStats, len(cs))
+	wg := sync.WaitGroup{}
+	for i, ct := range cs {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			ins, err := c.runner.Inspect(id)
+			if err != nil {
+				return // container went away
+			}
+			st := &ContainerStats{Container: *ins}
+			if ins.State == "running" {
+				if s, err := c.runner.Stats(id); err == nil {
+					st.Stats = *s
+				}
+			}
+			all[i] = st
+		}(i, ct.ID)
 	}
-	err = c.Login("logout")
-	return nil, err
-}
-func (c *Compose) Logs(args []string) ([]byte, error) {
-	return c.run(append([]string{"logs"}, args...)...)
+	wg.Wait()
+	stats := make([]ContainerStats, 0, len(cs))
+	for _, st := range all {
+		if st != nil {
+			stats = append(stats, *st)
+		}
+	}
+	return stats, nil
 }
-func (c *Compose) Ps(args []string) ([]byte, error) {
-	return c.run(append([]string{"ps"}, args...)...)
+
+// ImageDigests returns the repository digests of image.
+func (c *Compose) ImageDigests(image string) ([]string, error) { return c.runner.ImageDigests(image) }
+
+// Events returns a channel with the container events of the compose project, until ctx is canceled.
+func (c *Compose) Events(ctx context.Context) (<-chan Event, error) {
+	return c.runner.Events(ctx, c.Project())
 }
-func (c *Compose) Exec(args []string) ([]byte, error) {
-	return c.run(append([]string{"exec", "-T"}, args...)...)
+func (c *Compose) Exec(ctx context.Context, args []string) ([]byte, error) {
+	return c.run(ctx, append([]string{"exec", "-T"}, args...)...)
 }
 
 // Load loads the compose files and returns any errors.
@@ -142,8 +203,14 @@ func (c *Compose) Load(args []string) ([]byte, error) {
 	if err := c.AllowedVolumes(); err != nil {
 		return nil, err
 	}
+	if err := c.AllowedSecrets(); err != nil {
+		return nil, err
+	}
 	if err := c.Disallow(); err != nil {
 		return nil, err
 	}
+	if err := c.AllowedTargets(); err != nil {
+		return nil, err
+	}
 	return nil, nil
 }
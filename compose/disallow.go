@@ -1,7 +1,6 @@
 package compose
 
 import (
-	"fmt"
 	"path/filepath"
 	"strings"
 )
@@ -24,40 +23,37 @@ func disallow(file, name string, env []string) error {
 	}
 
 	if len(tp.Configs) > 0 {
-		return fmt.Errorf("Compose file %q uses configs", name)
-	}
-	if len(tp.Secrets) > 0 {
-		return fmt.Errorf("Compose file %q uses secrets", name)
+		return violation("configs", "Compose file %q uses configs", name)
 	}
 
 	for _, s := range tp.Services {
 		if len(s.SecurityOpt) > 1 {
 			// enfore '"no-new-privileges=true"' is set soon.
-			return fmt.Errorf("Service %q sets more than 1 security option", s.Name)
+			return violation("security_opt", "Service %q sets more than 1 security option", s.Name)
 		}
 		if s.Ipc != "" {
-			return fmt.Errorf("Service %q sets ipc", s.Name)
+			return violation("ipc", "Service %q sets ipc", s.Name)
 		}
 		if s.Privileged {
-			return fmt.Errorf("Service %q sets privileged = true", s.Name)
+			return violation("privileged", "Service %q sets privileged = true", s.Name)
 		}
 		if len(s.Devices) > 0 {
-			return fmt.Errorf("Service %q uses devices", s.Name)
+			return violation("devices", "Service %q uses devices", s.Name)
 		}
 		if len(s.StorageOpt) > 0 {
-			return fmt.Errorf("Service %q uses storage opts", s.Name)
+			return violation("storage_opt", "Service %q uses storage opts", s.Name)
 		}
 		if len(s.CapAdd) > 0 {
-			return fmt.Errorf("Service %q want to expand it capabilities", s.Name)
+			return violation("cap_add", "Service %q want to expand it capabilities", s.Name)
 		}
 		if strings.ToLower(s.NetworkMode) == "host" {
-			return fmt.Errorf("Service %q sets network_mode = 'host'", s.Name)
+			return violation("network_mode", "Service %q sets network_mode = 'host'", s.Name)
 		}
 		if strings.ToLower(s.Ipc) == "host" {
-			return fmt.Errorf("Service %q sets ipc = 'host'", s.Name)
+			return violation("ipc", "Service %q sets ipc = 'host'", s.Name)
 		}
 		if s.Ports != nil {
-			return fmt.Errorf("Service %q uses ports. Use 'expose' instead", s.Name)
+			return violation("ports", "Service %q uses ports. Use 'expose' instead", s.Name)
 		}
 	}
 	return nil
@@ -15,6 +15,9 @@ func TestDisallowPorts(t *testing.T) {
 	if err == nil {
 		t.Fatal("expected error, got none")
 	}
+	if r := Rule(err); r != "ports" {
+		t.Errorf("expected rule %q, got %q", "ports", r)
+	}
 	t.Logf(err.Error())
 }
 
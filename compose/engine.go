@@ -0,0 +1,318 @@
+package compose
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// DockerSocket is the default location of the docker socket, it's overridden by a unix:// DOCKER_HOST.
+const DockerSocket = "/var/run/docker.sock"
+
+// Labels docker compose sets on every container it creates.
+const (
+	ProjectLabel = "com.docker.compose.project"
+	ServiceLabel = "com.docker.compose.service"
+)
+
+// Container is a container as seen by the Docker Engine API.
+type Container struct {
+	ID      string
+	Name    string // without the leading slash
+	Image   string
+	Service string // the compose service this container belongs to
+	State   string // created, running, paused, restarting, removing, exited or dead
+	Status  string // human readable status, i.e. "Up 2 hours"
+	Created time.Time
+
+	// Only set by Inspect.
+	Health       string // starting, healthy, unhealthy or empty if there is no health check
+	RestartCount int
+	ExitCode     int
+	OOMKilled    bool
+	Networks     map[string]string // network name -> IP address of the container
+}
+
+// Event is a container event as seen by the Docker Engine API.
+type Event struct {
+	ID         string // container ID
+	Action     string // die, oom, restart, start, health_status: healthy, ...
+	Service    string // the compose service this container belongs to
+	Name       string // container name
+	Attributes map[string]string
+	Time       time.Time
+}
+
+// Stats is the resource usage of a container as seen by the Docker Engine API. Counters are totals since the
+// container started.
+type Stats struct {
+	CPUSeconds       float64 // CPU time used
+	MemoryBytes      uint64  // memory used, without the inactive page cache
+	MemoryLimitBytes uint64
+	NetRxBytes       uint64 // received on all interfaces
+	NetTxBytes       uint64 // transmitted on all interfaces
+	BlockReadBytes   uint64
+	BlockWriteBytes  uint64
+}
+
+// Engine talks to the Docker Engine API over a unix socket.
+type Engine struct {
+	socket string
+	client *http.Client
+}
+
+// NewEngine returns a pointer to an initialized Engine that uses socket. If socket is empty a unix://
+// DOCKER_HOST is used, and if that isn't set, DockerSocket.
+func NewEngine(socket string) *Engine {
+	if socket == "" {
+		socket = DockerSocket
+		if h := os.Getenv("DOCKER_HOST"); strings.HasPrefix(h, "unix://") {
+			socket = strings.TrimPrefix(h, "unix://")
+		}
+	}
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &Engine{socket: socket, client: &http.Client{Transport: tr}}
+}
+
+func (e *Engine) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := url.URL{Scheme: "http", Host: "docker", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg := struct{ Message string }{}
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&msg)
+		return nil, fmt.Errorf("docker API %s: %s: %s", path, resp.Status, msg.Message)
+	}
+	return resp, nil
+}
+
+func (e *Engine) getJSON(path string, query url.Values, v any) error {
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+	resp, err := e.get(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// projectFilter returns the filters query parameter that selects the containers of project.
+func projectFilter(project string, extra map[string][]string) url.Values {
+	f := map[string][]string{"label": {ProjectLabel + "=" + project}}
+	for k, v := range extra {
+		f[k] = v
+	}
+	buf, _ := json.Marshal(f)
+	return url.Values{"filters": []string{string(buf)}}
+}
+
+// Containers returns all containers, also the stopped ones, of the compose project.
+func (e *Engine) Containers(project string) ([]Container, error) {
+	list := []struct {
+		ID      string `json:"Id"`
+		Names   []string
+		Image   string
+		Labels  map[string]string
+		State   string
+		Status  string
+		Created int64
+	}{}
+	query := projectFilter(project, nil)
+	query.Set("all", "1")
+	if err := e.getJSON("/containers/json", query, &list); err != nil {
+		return nil, err
+	}
+	cs := make([]Container, len(list))
+	for i, l := range list {
+		cs[i] = Container{ID: l.ID, Image: l.Image, Service: l.Labels[ServiceLabel], State: l.State, Status: l.Status, Created: time.Unix(l.Created, 0)}
+		if len(l.Names) > 0 {
+			cs[i].Name = strings.TrimPrefix(l.Names[0], "/")
+		}
+	}
+	return cs, nil
+}
+
+// Inspect returns the container with id.
+func (e *Engine) Inspect(id string) (*Container, error) {
+	i := struct {
+		ID           string `json:"Id"`
+		Name         string
+		Created      time.Time
+		RestartCount int
+		State        struct {
+			Status    string
+			ExitCode  int
+			OOMKilled bool
+			Health    *struct{ Status string }
+		}
+		Config struct {
+			Image  string
+			Labels map[string]string
+		}
+		NetworkSettings struct {
+			Networks map[string]struct{ IPAddress string }
+		}
+	}{}
+	if err := e.getJSON("/containers/"+url.PathEscape(id)+"/json", nil, &i); err != nil {
+		return nil, err
+	}
+	c := &Container{
+		ID:           i.ID,
+		Name:         strings.TrimPrefix(i.Name, "/"),
+		Image:        i.Config.Image,
+		Service:      i.Config.Labels[ServiceLabel],
+		State:        i.State.Status,
+		Status:       i.State.Status,
+		Created:      i.Created,
+		RestartCount: i.RestartCount,
+		ExitCode:     i.State.ExitCode,
+		OOMKilled:    i.State.OOMKilled,
+	}
+	if i.State.Health != nil {
+		c.Health = i.State.Health.Status
+	}
+	if len(i.NetworkSettings.Networks) > 0 {
+		c.Networks = map[string]string{}
+		for n, s := range i.NetworkSettings.Networks {
+			c.Networks[n] = s.IPAddress
+		}
+	}
+	return c, nil
+}
+
+// Stats returns the resource usage of the (running) container with id.
+func (e *Engine) Stats(id string) (*Stats, error) {
+	st := struct {
+		CPUStats struct {
+			CPUUsage struct {
+				TotalUsage uint64 `json:"total_usage"` // nanoseconds
+			} `json:"cpu_usage"`
+		} `json:"cpu_stats"`
+		MemoryStats struct {
+			Usage uint64            `json:"usage"`
+			Limit uint64            `json:"limit"`
+			Stats map[string]uint64 `json:"stats"`
+		} `json:"memory_stats"`
+		Networks map[string]struct {
+			RxBytes uint64 `json:"rx_bytes"`
+			TxBytes uint64 `json:"tx_bytes"`
+		} `json:"networks"`
+		BlkioStats struct {
+			IOServiceBytesRecursive []struct {
+				Op    string `json:"op"`
+				Value uint64 `json:"value"`
+			} `json:"io_service_bytes_recursive"`
+		} `json:"blkio_stats"`
+	}{}
+	query := url.Values{"stream": []string{"false"}, "one-shot": []string{"true"}}
+	if err := e.getJSON("/containers/"+url.PathEscape(id)+"/stats", query, &st); err != nil {
+		return nil, err
+	}
+	s := &Stats{
+		CPUSeconds:       float64(st.CPUStats.CPUUsage.TotalUsage) / 1e9,
+		MemoryBytes:      st.MemoryStats.Usage,
+		MemoryLimitBytes: st.MemoryStats.Limit,
+	}
+	// Like docker stats, don't count the page cache that can be reclaimed: inactive_file for cgroup v2,
+	// total_inactive_file for v1.
+	inactive, ok := st.MemoryStats.Stats["inactive_file"]
+	if !ok {
+		inactive = st.MemoryStats.Stats["total_inactive_file"]
+	}
+	if inactive < s.MemoryBytes {
+		s.MemoryBytes -= inactive
+	}
+	for _, n := range st.Networks {
+		s.NetRxBytes += n.RxBytes
+		s.NetTxBytes += n.TxBytes
+	}
+	for _, b := range st.BlkioStats.IOServiceBytesRecursive {
+		switch strings.ToLower(b.Op) {
+		case "read":
+			s.BlockReadBytes += b.Value
+		case "write":
+			s.BlockWriteBytes += b.Value
+		}
+	}
+	return s, nil
+}
+
+// CgroupDriver returns the cgroup driver docker uses: "systemd" or "cgroupfs".
+func (e *Engine) CgroupDriver() (string, error) {
+	i := struct{ CgroupDriver string }{}
+	if err := e.getJSON("/info", nil, &i); err != nil {
+		return "", err
+	}
+	return i.CgroupDriver, nil
+}
+
+// ImageDigests returns the repository digests of image.
+func (e *Engine) ImageDigests(image string) ([]string, error) {
+	i := struct{ RepoDigests []string }{}
+	if err := e.getJSON("/images/"+image+"/json", nil, &i); err != nil {
+		return nil, err
+	}
+	return i.RepoDigests, nil
+}
+
+// Events returns a channel on which the container events of the compose project are send. The channel is
+// closed when ctx is canceled or the connection to docker is lost.
+func (e *Engine) Events(ctx context.Context, project string) (<-chan Event, error) {
+	resp, err := e.get(ctx, "/events", projectFilter(project, map[string][]string{"type": {"container"}}))
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		defer resp.Body.Close()
+		dec := json.NewDecoder(resp.Body)
+		for {
+			m := struct {
+				Action string
+				Actor  struct {
+					ID         string
+					Attributes map[string]string
+				}
+				TimeNano int64 `json:"timeNano"`
+			}{}
+			if err := dec.Decode(&m); err != nil {
+				return
+			}
+			ev := Event{
+				ID:         m.Actor.ID,
+				Action:     m.Action,
+				Service:    m.Actor.Attributes[ServiceLabel],
+				Name:       m.Actor.Attributes["name"],
+				Attributes: m.Actor.Attributes,
+				Time:       time.Unix(0, m.TimeNano),
+			}
+			select {
+			case ch <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,117 @@
+package compose
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestEngine returns an Engine talking to a fake docker daemon on a unix socket.
+func newTestEngine(t *testing.T, handler http.Handler) *Engine {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return NewEngine(socket)
+}
+
+func TestEngineContainers(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		if f := r.URL.Query().Get("filters"); f != `{"label":["com.docker.compose.project=pgo"]}` {
+			t.Errorf("unexpected filters: %s", f)
+		}
+		fmt.Fprint(w, `[{"Id":"abc","Names":["/pgo-frontend-1"],"Image":"busybox","State":"running","Status":"Up 9 minutes",
+"Labels":{"com.docker.compose.project":"pgo","com.docker.compose.service":"frontend"}}]`)
+	})
+	e := newTestEngine(t, mux)
+
+	cs, err := e.Containers("pgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 1 {
+		t.Fatalf("expected 1 container, got %d", len(cs))
+	}
+	if cs[0].Name != "pgo-frontend-1" || cs[0].Service != "frontend" || cs[0].State != "running" {
+		t.Errorf("unexpected container: %+v", cs[0])
+	}
+}
+
+func TestEngineEvents(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"Type":"container","Action":"die","Actor":{"ID":"abc","Attributes":{"name":"pgo-frontend-1","com.docker.compose.service":"frontend","exitCode":"1"}},"timeNano":1}`+"\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	e := newTestEngine(t, mux)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := e.Events(ctx, "pgo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-ch:
+		if ev.Action != "die" || ev.Service != "frontend" || ev.Attributes["exitCode"] != "1" {
+			t.Errorf("unexpected event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+}
+
+func TestEngineStats(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/abc/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("stream") != "false" {
+			t.Errorf("expected stream=false, got %q", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, `{"cpu_stats":{"cpu_usage":{"total_usage":2500000000}},
+"memory_stats":{"usage":1000,"limit":4000,"stats":{"inactive_file":200}},
+"networks":{"eth0":{"rx_bytes":10,"tx_bytes":20},"eth1":{"rx_bytes":1,"tx_bytes":2}},
+"blkio_stats":{"io_service_bytes_recursive":[{"op":"read","value":5},{"op":"write","value":7},{"op":"Read","value":1}]}}`)
+	})
+	e := newTestEngine(t, mux)
+
+	s, err := e.Stats("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := Stats{CPUSeconds: 2.5, MemoryBytes: 800, MemoryLimitBytes: 4000, NetRxBytes: 11, NetTxBytes: 22, BlockReadBytes: 6, BlockWriteBytes: 7}
+	if *s != expect {
+		t.Errorf("expected %+v, got %+v", expect, *s)
+	}
+}
+
+func TestEngineInspect(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/abc/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"Id":"abc","Name":"/pgo-frontend-1","RestartCount":2,
+"State":{"Status":"running","Health":{"Status":"healthy"}},
+"Config":{"Image":"busybox","Labels":{"com.docker.compose.service":"frontend"}},
+"NetworkSettings":{"Networks":{"reverse_proxy":{"IPAddress":"172.18.0.3"}}}}`)
+	})
+	e := newTestEngine(t, mux)
+
+	c, err := e.Inspect("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "pgo-frontend-1" || c.Service != "frontend" || c.Health != "healthy" || c.RestartCount != 2 {
+		t.Errorf("unexpected container %+v", c)
+	}
+	if c.Networks["reverse_proxy"] != "172.18.0.3" {
+		t.Errorf("expected address on reverse_proxy network, got %v", c.Networks)
+	}
+}
@@ -0,0 +1,139 @@
+package compose
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Fake is an in-memory Runner to be used in tests, it doesn't need docker. It records all commands that are
+// run, and returns the containers set with SetContainers. Events can be send with Emit.
+type Fake struct {
+	mu         sync.Mutex
+	calls      [][]string
+	errs       map[string]error // error to return per (compose) subcommand
+	containers []Container
+	subs       []*fakeSub
+}
+
+type fakeSub struct {
+	ctx context.Context
+	ch  chan Event
+}
+
+// NewFake returns a pointer to an initialized Fake.
+func NewFake() *Fake { return &Fake{errs: map[string]error{}} }
+
+// Calls returns all commands that have been run, the first element is "compose" for compose commands and
+// "engine" for the others.
+func (f *Fake) Calls() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]string{}, f.calls...)
+}
+
+// Subcommands returns the compose subcommands (up, down, ...) that have been run in order.
+func (f *Fake) Subcommands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	subs := []string{}
+	for _, c := range f.calls {
+		if c[0] == "compose" {
+			subs = append(subs, subcommand(c))
+		}
+	}
+	return subs
+}
+
+// subcommand returns the subcommand from the recorded args, skipping the --file flag.
+func subcommand(args []string) string {
+	for i := 1; i < len(args); i++ {
+		if args[i] == "--file" {
+			i++
+			continue
+		}
+		return args[i]
+	}
+	return ""
+}
+
+// SetError sets the error returned for the compose or engine subcommand sub.
+func (f *Fake) SetError(sub string, err error) { f.mu.Lock(); defer f.mu.Unlock(); f.errs[sub] = err }
+
+// SetContainers sets the containers returned by Containers and Inspect.
+func (f *Fake) SetContainers(cs ...Container) { f.mu.Lock(); defer f.mu.Unlock(); f.containers = cs }
+
+// Emit sends e to all channels returned by Events, it blocks until e is received or the context given to
+// Events is canceled.
+func (f *Fake) Emit(e Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range f.subs {
+		select {
+		case s.ch <- e:
+		case <-s.ctx.Done():
+		}
+	}
+}
+
+func (f *Fake) record(args []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, args)
+	return f.errs[subcommand(args)]
+}
+
+func (f *Fake) Compose(c *Compose, args ...string) ([]byte, error) {
+	return nil, f.record(append([]string{"compose"}, args...))
+}
+
+func (f *Fake) Command(c *Compose, args ...string) ([]byte, error) {
+	return nil, f.record(append([]string{"engine"}, args...))
+}
+
+func (f *Fake) Containers(project string) ([]Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Container{}, f.containers...), nil
+}
+
+func (f *Fake) Inspect(id string) (*Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.containers {
+		if c.ID == id {
+			return &c, nil
+		}
+	}
+	return nil, fmt.Errorf("no such container: %s", id)
+}
+
+func (f *Fake) Stats(id string) (*Stats, error) {
+	if _, err := f.Inspect(id); err != nil {
+		return nil, err
+	}
+	return &Stats{}, nil
+}
+
+func (f *Fake) ImageDigests(image string) ([]string, error) { return nil, nil }
+
+func (f *Fake) Events(ctx context.Context, project string) (<-chan Event, error) {
+	s := &fakeSub{ctx: ctx, ch: make(chan Event)}
+	f.mu.Lock()
+	f.subs = append(f.subs, s)
+	f.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for i := range f.subs {
+			if f.subs[i] == s {
+				f.subs = append(f.subs[:i], f.subs[i+1:]...)
+				break
+			}
+		}
+		close(s.ch)
+	}()
+	return s.ch, nil
+}
@@ -3,6 +3,8 @@ package compose
 import (
 	"fmt"
 	"path/filepath"
+	"slices"
+	"sort"
 )
 
 // AllowedExternalNetworks returns an error if any of the external networks are not allowed.
@@ -19,7 +21,7 @@ func (c *Compose) AllowedExternalNetworks() error {
 		return err
 	}
 	if len(allnets) < 2 {
-		return fmt.Errorf("file %q you must have at least 2 (have %v) networks, one of them should be external", comp, allnets)
+		return violation("networks", "file %q you must have at least 2 (have %v) networks, one of them should be external", comp, allnets)
 	}
 
 	nets, err := loadExternalNetworks(comp, c.name, c.env)
@@ -34,13 +36,43 @@ func (c *Compose) AllowedExternalNetworks() error {
 			}
 		}
 		if !ok {
-			return fmt.Errorf("file %q network %s is not allowed, allowed networks: %v", comp, n, c.nets)
+			return violation("networks", "file %q network %s is not allowed, allowed networks: %v", comp, n, c.nets)
 		}
 	}
 
 	return nil
 }
 
+// ExternalNetworks returns the (sorted) names of the external networks the compose service is attached to, these
+// are shared with the reverse proxy. If networks are set for c, only those are returned.
+func (c *Compose) ExternalNetworks(service string) ([]string, error) {
+	comp := Find(c.dir)
+	if c.file != "" {
+		comp = filepath.Join(c.dir, c.file)
+	}
+	tp, err := load(comp, c.name, c.env)
+	if err != nil {
+		return nil, err
+	}
+	s, err := tp.GetService(service)
+	if err != nil {
+		return nil, fmt.Errorf("no service %q in compose project", service)
+	}
+	nets := []string{}
+	for n := range s.Networks {
+		net := tp.Networks[n]
+		if !net.External {
+			continue
+		}
+		if c.nets != nil && !slices.Contains(c.nets, net.Name) {
+			continue
+		}
+		nets = append(nets, net.Name) // use n.Name, not n.External.Name
+	}
+	sort.Strings(nets)
+	return nets, nil
+}
+
 func loadExternalNetworks(file, name string, env []string) ([]string, error) {
 	tp, err := load(file, name, env)
 	if err != nil {
@@ -0,0 +1,84 @@
+package compose
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// OverrideFile is the suffix of the compose override file that sets cgroup_parent and labels, it's written next
+// to the checkout directory.
+const OverrideFile = ".override.yaml"
+
+// SetCgroupParent makes all containers of c run under parent, this is a systemd slice (i.e. "pgo-caddy.slice")
+// when docker uses the systemd cgroup driver, or a cgroup path (i.e. "/pgo-caddy") for the cgroupfs driver.
+// An empty parent leaves cgroup_parent as set in the compose file.
+func (c *Compose) SetCgroupParent(parent string) { c.cgroupParent = parent }
+
+// SetLabels adds labels to the compose services of c, labels is keyed by compose service name. Labels for
+// services that aren't in the compose file are ignored.
+func (c *Compose) SetLabels(labels map[string]map[string]string) { c.labels = labels }
+
+// override writes a compose override file that sets cgroup_parent for all services of the compose project and
+// adds the labels, and returns its path.
+func (c *Compose) override() (string, error) {
+	comp := Find(c.dir)
+	if c.file != "" {
+		comp = filepath.Join(c.dir, c.file)
+	}
+	tp, err := load(comp, c.name, c.env)
+	if err != nil {
+		return "", err
+	}
+	names := tp.ServiceNames()
+	sort.Strings(names)
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "# Generated by pgod, do not edit.\nservices:\n")
+	for _, n := range names {
+		if c.cgroupParent == "" && len(c.labels[n]) == 0 {
+			continue
+		}
+		fmt.Fprintf(b, "  %q:\n", n)
+		if c.cgroupParent != "" {
+			fmt.Fprintf(b, "    cgroup_parent: %q\n", c.cgroupParent)
+		}
+		if len(c.labels[n]) == 0 {
+			continue
+		}
+		fmt.Fprintf(b, "    labels:\n")
+		keys := make([]string, 0, len(c.labels[n]))
+		for k := range c.labels[n] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			// compose interpolates $ in values, i.e. in bcrypt hashes
+			fmt.Fprintf(b, "      %q: %q\n", k, strings.ReplaceAll(c.labels[n][k], "$", "$$"))
+		}
+	}
+	file := filepath.Clean(c.dir) + OverrideFile
+	if err := os.WriteFile(file, []byte(b.String()), 0644); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// overrideArgs returns the --file flags that docker compose needs to use the override file, or nil when no
+// cgroup parent and no labels are set.
+func (c *Compose) overrideArgs() ([]string, error) {
+	if c.cgroupParent == "" && len(c.labels) == 0 {
+		return nil, nil
+	}
+	file, err := c.override()
+	if err != nil {
+		return nil, err
+	}
+	comp := Find(c.dir)
+	if c.file != "" {
+		comp = c.file
+	}
+	return []string{"--file", comp, "--file", file}, nil
+}
@@ -0,0 +1,100 @@
+package compose
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/compose-spec/compose-go/v2/cli"
+)
+
+func TestOverride(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "bliep")
+	os.Mkdir(dir, 0755)
+	data, err := os.ReadFile("testdata/docker-compose.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "docker-compose.yml"), data, 0644)
+
+	c := New("bliep", "root", dir, "", "", nil, nil, nil, "")
+	if args, _ := c.overrideArgs(); args != nil {
+		t.Fatalf("expected no override without cgroup parent, got %v", args)
+	}
+
+	c.SetCgroupParent("pgo-bliep.slice")
+	args, err := c.overrideArgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 4 || args[3] != dir+OverrideFile {
+		t.Fatalf("expected --file flags with override, got %v", args)
+	}
+	over, _ := os.ReadFile(args[3])
+	const expect = `# Generated by pgod, do not edit.
+services:
+  "frontend":
+    cgroup_parent: "pgo-bliep.slice"
+  "redis":
+    cgroup_parent: "pgo-bliep.slice"
+`
+	if string(over) != expect {
+		t.Errorf("expected override\n%s, got\n%s", expect, over)
+	}
+
+	o, _ := cli.NewProjectOptions([]string{args[1], args[3]}, cli.WithName("bliep"))
+	tp, err := cli.ProjectFromOptions(context.TODO(), o)
+	if err != nil {
+		t.Fatalf("expected override to merge, got %s", err)
+	}
+	for _, s := range tp.Services {
+		if s.CgroupParent != "pgo-bliep.slice" {
+			t.Errorf("expected cgroup_parent %q for %q, got %q", "pgo-bliep.slice", s.Name, s.CgroupParent)
+		}
+	}
+}
+
+func TestOverrideLabels(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "bliep")
+	os.Mkdir(dir, 0755)
+	data, err := os.ReadFile("testdata/docker-compose.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "docker-compose.yml"), data, 0644)
+
+	c := New("bliep", "root", dir, "", "", nil, nil, nil, "")
+	c.SetLabels(map[string]map[string]string{
+		"frontend": {"traefik.enable": "true", "traefik.http.middlewares.x.basicauth.users": "miek:$2a$14$abc"},
+		"unknown":  {"traefik.enable": "true"},
+	})
+	args, err := c.overrideArgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	over, _ := os.ReadFile(args[3])
+	const expect = `# Generated by pgod, do not edit.
+services:
+  "frontend":
+    labels:
+      "traefik.enable": "true"
+      "traefik.http.middlewares.x.basicauth.users": "miek:$$2a$$14$$abc"
+`
+	if string(over) != expect {
+		t.Errorf("expected override\n%s, got\n%s", expect, over)
+	}
+
+	o, _ := cli.NewProjectOptions([]string{args[1], args[3]}, cli.WithName("bliep"))
+	tp, err := cli.ProjectFromOptions(context.TODO(), o)
+	if err != nil {
+		t.Fatalf("expected override to merge, got %s", err)
+	}
+	fe, err := tp.GetService("frontend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := fe.Labels["traefik.http.middlewares.x.basicauth.users"]; u != "miek:$2a$14$abc" {
+		t.Errorf("expected label to survive interpolation, got %q", u)
+	}
+}
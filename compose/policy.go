@@ -0,0 +1,28 @@
+package compose
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PolicyError is returned when a compose file violates one of pgod's rules, i.e. it uses ports.
+type PolicyError struct {
+	Rule string // short name of the rule, i.e. "ports"
+	msg  string
+}
+
+func (e *PolicyError) Error() string { return e.msg }
+
+// violation returns a *PolicyError for rule, with a message formatted as fmt.Errorf does.
+func violation(rule, format string, a ...any) error {
+	return &PolicyError{Rule: rule, msg: fmt.Sprintf(format, a...)}
+}
+
+// Rule returns the rule err violates, or the empty string if err isn't a policy violation.
+func Rule(err error) string {
+	pe := &PolicyError{}
+	if errors.As(err, &pe) {
+		return pe.Rule
+	}
+	return ""
+}
@@ -2,68 +2,100 @@ package compose
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"os/exec"
+	"os"
+	"path/filepath"
 	"strings"
 
-	"github.com/miekg/pgo/metric"
 	"github.com/miekg/pgo/osutil"
-	"go.science.ru.nl/log"
+	"github.com/miekg/pgo/tracing"
 )
 
-func (c *Compose) Login(login string /*logout*/) error {
-	if len(c.registries) == 0 {
-		return nil
+// SplitRegistry splits r, in "[user:]token@registry" format, in the credentials and the registry. The last
+// @-sign separates them: the token may contain one, the registry can't.
+func SplitRegistry(r string) (cred, registry string, ok bool) {
+	i := strings.LastIndex(r, "@")
+	if i < 0 {
+		return r, "", false
 	}
+	return r[:i], r[i+1:], true
+}
 
-	for _, r := range c.registries {
-		regi := strings.Index(r, "@")
-		if regi < 0 {
-			return fmt.Errorf("no @-sign in registry %q", r)
-		}
-		registry := r[regi+1:]
-
-		user := ""
-		token := ""
-		fields := strings.SplitN(r[:regi], ":", 2)
-		switch len(fields) {
-		case 1:
-			user = c.user
-			token = fields[0]
-		case 2:
-			user = fields[0]
-			token = fields[1]
-		}
+// Auth parses the registry r, in "[user:]token@registry" format, and returns the registry, user and token. If
+// the user is omitted, user is used.
+func Auth(r, user string) (registry, u, token string, err error) {
+	cred, registry, ok := SplitRegistry(r)
+	if !ok {
+		return "", "", "", fmt.Errorf("no @-sign in registry") // don't echo r, it holds the token
+	}
+	u, token, ok = strings.Cut(cred, ":")
+	if !ok {
+		u, token = user, cred
+	}
+	if strings.Contains(u, "@") {
+		return "", "", "", fmt.Errorf("@-sign in registry user")
+	}
+	return registry, u, token, nil
+}
 
-		// do docker login
-		ctx := context.TODO()
-		log.Infof("[%s]: Performing docker %s with %q at %q", c.name, login, user, registry)
-		cmd := exec.CommandContext(ctx, "docker", login, "-u", user, "-p", token, registry)
-		if login == "logout" {
-			cmd = exec.CommandContext(ctx, "docker", "logout")
-		}
-		if err := osutil.RunAs(cmd, c.user); err != nil {
-			return err
-		}
-		cmd.Dir = c.dir
-		cmd.Env = append(cmd.Env, c.env...)
+// SetDockerConfig sets the directory used as DOCKER_CONFIG, this isolates the docker (and podman) credentials of
+// c from other services running as the same user. See WriteDockerConfig.
+func (c *Compose) SetDockerConfig(dir string) { c.dockerConfig = dir }
 
-		metric.CmdCount.WithLabelValues(c.name, "docker", login).Inc()
+// WriteDockerConfig writes a config.json with the auths of all registries of c into the directory set with
+// SetDockerConfig. The directory and file are only accessible by c's user. Docker (compose) then pulls from
+// these registries without the need to do a docker login. Ctx carries the span of the caller.
+func (c *Compose) WriteDockerConfig(ctx context.Context) (err error) {
+	span := tracing.Command(ctx, c.name, "registry auth")
+	defer func() { tracing.Exit(span, err) }()
 
-		if login == "login" {
-			log.Debugf("[%s]: running in %q as %q %v (env: %v)", c.name, cmd.Dir, c.user, cmd.Args[:len(cmd.Args)-2], osutil.EnvVars(c.env)) // -2 to not leak pw
-		} else {
-			log.Debugf("[%s]: running in %q as %q %v (env: %v)", c.name, cmd.Dir, c.user, cmd.Args, osutil.EnvVars(c.env))
+	if c.dockerConfig == "" {
+		return fmt.Errorf("no docker config directory for %q", c.name)
+	}
+	type auth struct {
+		Auth string `json:"auth"`
+	}
+	cfg := struct {
+		Auths map[string]auth `json:"auths"`
+	}{Auths: map[string]auth{}}
+	for _, r := range c.registries {
+		registry, user, token, err := Auth(r, c.user)
+		if err != nil {
+			return err
 		}
+		cfg.Auths[registry] = auth{Auth: base64.StdEncoding.EncodeToString([]byte(user + ":" + token))}
+	}
+	buf, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		return err
+	}
 
-		out, err := cmd.CombinedOutput()
-		if len(out) > 0 {
-			log.Debugf("[%s]: %s", c.name, string(out))
-		}
-		if err != nil {
-			metric.CmdErrorCount.WithLabelValues(c.name, "docker", login).Inc()
+	if err := os.MkdirAll(c.dockerConfig, 0700); err != nil {
+		return err
+	}
+	// The directory is owned by c's user, who could plant a symlink in it: don't follow those as root.
+	d, err := osutil.OpenDir(c.dockerConfig)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	uid, gid := -1, -1
+	if os.Geteuid() == 0 {
+		u, g := osutil.User(c.user)
+		uid, gid = int(u), int(g)
+		if err := d.Chown(uid, gid); err != nil {
 			return err
 		}
 	}
-	return nil
+	return osutil.WriteFileAt(d, "config.json", buf, 0600, uid, gid)
+}
+
+// dockerEnv returns the environment variables that point docker and podman to c's docker config.
+func (c *Compose) dockerEnv() []string {
+	if c.dockerConfig == "" {
+		return nil
+	}
+	return []string{"DOCKER_CONFIG=" + c.dockerConfig, "REGISTRY_AUTH_FILE=" + filepath.Join(c.dockerConfig, "config.json")}
 }
@@ -0,0 +1,68 @@
+package compose
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuth(t *testing.T) {
+	tests := []struct {
+		r                     string
+		registry, user, token string
+	}{
+		{"miek:secret@registry.example.org", "registry.example.org", "miek", "secret"},
+		{"secret@registry.example.org", "registry.example.org", "bliep", "secret"},
+		{"miek:sec@ret@registry.example.org", "registry.example.org", "miek", "sec@ret"},
+	}
+	for _, tc := range tests {
+		registry, user, token, err := Auth(tc.r, "bliep")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if registry != tc.registry || user != tc.user || token != tc.token {
+			t.Errorf("expected %q %q %q, got %q %q %q", tc.registry, tc.user, tc.token, registry, user, token)
+		}
+	}
+	if _, _, _, err := Auth("miek:secret", "bliep"); err == nil {
+		t.Error("expected error for registry without @, got none")
+	}
+	if _, _, _, err := Auth("miek@example.org:secret@registry.example.org", "bliep"); err == nil {
+		t.Error("expected error for user with @, got none")
+	}
+}
+
+func TestWriteDockerConfig(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "bliep")
+	c := New("bliep", "root", "", "", "", []string{"miek:secret@registry.example.org"}, nil, nil, "")
+	if err := c.WriteDockerConfig(context.Background()); err == nil {
+		t.Fatal("expected error without docker config directory, got none")
+	}
+
+	c.SetDockerConfig(dir)
+	if err := c.WriteDockerConfig(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expect = `{
+	"auths": {
+		"registry.example.org": {
+			"auth": "bWllazpzZWNyZXQ="
+		}
+	}
+}`
+	if string(buf) != expect {
+		t.Errorf("expected config.json\n%s\ngot\n%s", expect, buf)
+	}
+	info, _ := os.Stat(filepath.Join(dir, "config.json"))
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode %s, got %s", os.FileMode(0600), info.Mode().Perm())
+	}
+	if env := c.dockerEnv(); len(env) != 2 || env[0] != "DOCKER_CONFIG="+dir {
+		t.Errorf("expected DOCKER_CONFIG in environment, got %v", env)
+	}
+}
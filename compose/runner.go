@@ -0,0 +1,81 @@
+package compose
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/miekg/pgo/osutil"
+	"go.science.ru.nl/log"
+)
+
+// Runner runs the docker (compose) commands for a Compose and answers queries about its containers. CLI is the
+// implementation that uses the docker binaries and the Docker Engine API, Fake is an in-memory one for testing.
+type Runner interface {
+	// Compose runs docker compose with args for c, and returns the combined output.
+	Compose(c *Compose, args ...string) ([]byte, error)
+	// Command runs the container engine (docker or podman) with args for c, and returns the combined output.
+	Command(c *Compose, args ...string) ([]byte, error)
+
+	// Containers returns all containers of the compose project.
+	Containers(project string) ([]Container, error)
+	// Inspect returns the container with id.
+	Inspect(id string) (*Container, error)
+	// Stats returns the resource usage of the running container with id.
+	Stats(id string) (*Stats, error)
+	// ImageDigests returns the repository digests of image.
+	ImageDigests(image string) ([]string, error)
+	// Events returns a channel with the container events of the compose project, until ctx is canceled.
+	Events(ctx context.Context, project string) (<-chan Event, error)
+}
+
+// CLI is a Runner that executes docker compose (or docker-compose), or podman compose, as the Compose's user.
+// Queries are done with the Docker Engine API, which podman also implements.
+type CLI struct {
+	*Engine
+	engine string // osutil.Docker, osutil.DockerRootless or osutil.Podman
+	binary string // docker or podman
+}
+
+// NewCLI returns a pointer to an initialized CLI for engine (osutil.Docker, osutil.DockerRootless or
+// osutil.Podman) that uses socket for the Docker Engine API, see NewEngine.
+func NewCLI(engine, socket string) *CLI {
+	return &CLI{Engine: NewEngine(socket), engine: engine, binary: osutil.Binary(engine)}
+}
+
+func (r *CLI) Compose(c *Compose, args ...string) ([]byte, error) {
+	ctx := context.TODO()
+	args = append([]string{"compose"}, args...)
+	cmd := exec.CommandContext(ctx, r.binary, args...)
+
+	if r.binary != osutil.Docker {
+		return r.exec(c, cmd)
+	}
+	if _, err := exec.LookPath("docker-compose"); err == nil {
+		// docker-compose is the installed command, use that and strip compose out of args
+		args = args[1:]
+		cmd = exec.CommandContext(ctx, "docker-compose", args...)
+	}
+	return r.exec(c, cmd)
+}
+
+func (r *CLI) Command(c *Compose, args ...string) ([]byte, error) {
+	ctx := context.TODO()
+	return r.exec(c, exec.CommandContext(ctx, r.binary, args...))
+}
+
+func (r *CLI) exec(c *Compose, cmd *exec.Cmd) ([]byte, error) {
+	if err := osutil.RunAs(cmd, c.user, r.engine); err != nil {
+		return nil, err
+	}
+	cmd.Dir = c.dir
+	cmd.Env = append(cmd.Env, c.dockerEnv()...)
+	cmd.Env = append(cmd.Env, c.env...)
+
+	log.Debugf("[%s]: running in %q as %q %v (env: %v)", c.name, cmd.Dir, c.user, cmd.Args, osutil.EnvVars(c.env))
+
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		log.Debugf("[%s]: %s", c.name, string(out))
+	}
+	return out, err
+}
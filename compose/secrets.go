@@ -0,0 +1,31 @@
+package compose
+
+import (
+	"path/filepath"
+)
+
+// AllowedSecrets returns an error if any of the secrets in the compose file isn't a file that falls below
+// c.datadir. Secrets from the environment or external secrets are not allowed.
+func (c *Compose) AllowedSecrets() error {
+	comp := Find(c.dir)
+	if c.file != "" {
+		comp = filepath.Join(c.dir, c.file)
+	}
+	return allowedSecrets(comp, c.name, c.datadir, c.env)
+}
+
+func allowedSecrets(file, name, datadir string, env []string) error {
+	tp, err := load(file, name, env)
+	if err != nil {
+		return err
+	}
+	for n, s := range tp.Secrets {
+		if s.File == "" {
+			return violation("secrets", "secret %q is not a file", n)
+		}
+		if datadir == "" || !allowedPath(datadir, s.File) {
+			return violation("secrets", "secret %q file %s does not fall below %q", n, s.File, datadir)
+		}
+	}
+	return nil
+}
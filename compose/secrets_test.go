@@ -0,0 +1,15 @@
+package compose
+
+import "testing"
+
+func TestAllowedSecrets(t *testing.T) {
+	if err := allowedSecrets("testdata/docker-compose_secrets.yml", "", "/data/compose", nil); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if err := allowedSecrets("testdata/docker-compose_secrets.yml", "", "/data/other", nil); err == nil {
+		t.Fatal("expected error for secret outside of datadir, got none")
+	}
+	if err := allowedSecrets("testdata/docker-compose_secrets_env.yml", "", "/data/compose", []string{"DB_PASS=x"}); err == nil {
+		t.Fatal("expected error for secret from the environment, got none")
+	}
+}
@@ -0,0 +1,96 @@
+package compose
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/compose-spec/compose-go/v2/types"
+)
+
+// SetTargets sets the targets (service:port) the reverse proxy routes to, these are checked by BadTargets.
+func (c *Compose) SetTargets(targets []string) { c.targets = targets }
+
+// AllowedTargets returns an error if any of the targets is bad, see BadTargets.
+func (c *Compose) AllowedTargets() error {
+	bad, err := c.BadTargets()
+	if err != nil {
+		return err
+	}
+	if len(bad) == 0 {
+		return nil
+	}
+	errs := make([]string, 0, len(bad))
+	for _, err := range bad {
+		errs = append(errs, err.Error())
+	}
+	sort.Strings(errs)
+	return violation("targets", "%s", strings.Join(errs, "; "))
+}
+
+// BadTargets loads the compose file and returns an error for each target that doesn't name a service in the
+// project, whose port isn't exposed, or when that service isn't attached to an external (the proxy's) network.
+func (c *Compose) BadTargets() (map[string]error, error) {
+	if len(c.targets) == 0 {
+		return nil, nil
+	}
+	comp := Find(c.dir)
+	if c.file != "" {
+		comp = filepath.Join(c.dir, c.file)
+	}
+	tp, err := load(comp, c.name, c.env)
+	if err != nil {
+		return nil, err
+	}
+	bad := map[string]error{}
+	for _, t := range c.targets {
+		if err := badTarget(tp, t); err != nil {
+			bad[t] = err
+		}
+	}
+	return bad, nil
+}
+
+func badTarget(tp *types.Project, target string) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("target %q: %s", target, err)
+	}
+	s, err := tp.GetService(host)
+	if err != nil {
+		return violation("targets", "target %q: no service %q in compose project", target, host)
+	}
+	if !exposed(s.Expose, port) {
+		return violation("targets", "target %q: port %s is not exposed by service %q", target, port, host)
+	}
+	for n := range s.Networks {
+		if tp.Networks[n].External {
+			return nil
+		}
+	}
+	return violation("targets", "target %q: service %q is not attached to an external network", target, host)
+}
+
+// exposed returns true when port is in expose, which has ports and port ranges, with an optional protocol.
+func exposed(expose types.StringOrNumberList, port string) bool {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+	for _, e := range expose {
+		e, _, _ = strings.Cut(e, "/")
+		lo, hi, ok := strings.Cut(e, "-")
+		if !ok {
+			hi = lo
+		}
+		l, err1 := strconv.Atoi(lo)
+		h, err2 := strconv.Atoi(hi)
+		if err1 == nil && err2 == nil && l <= p && p <= h {
+			return true
+		}
+	}
+	return false
+}
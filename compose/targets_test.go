@@ -0,0 +1,45 @@
+package compose
+
+import (
+	"testing"
+)
+
+func TestBadTargets(t *testing.T) {
+	c := &Compose{dir: "testdata", file: "docker-compose_targets.yml"}
+	c.SetTargets([]string{"web:80", "web:8005", "web:8080", "db:6379", "api:80"})
+	bad, err := c.BadTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"web:8080", "db:6379", "api:80"} {
+		if bad[target] == nil {
+			t.Errorf("expected error for target %q, got none", target)
+		}
+	}
+	for _, target := range []string{"web:80", "web:8005"} {
+		if bad[target] != nil {
+			t.Errorf("expected no error for target %q, got %s", target, bad[target])
+		}
+	}
+	if err := c.AllowedTargets(); Rule(err) != "targets" {
+		t.Errorf("expected targets violation, got %v", err)
+	}
+}
+
+func TestExternalNetworks(t *testing.T) {
+	c := &Compose{dir: "testdata", file: "docker-compose_targets.yml"}
+	nets, err := c.ExternalNetworks("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 1 || nets[0] != "reverse_proxy" {
+		t.Errorf("expected %q, got %v", "reverse_proxy", nets)
+	}
+	if nets, _ := c.ExternalNetworks("db"); len(nets) != 0 {
+		t.Errorf("expected no external networks for db, got %v", nets)
+	}
+	c.nets = []string{"other"}
+	if nets, _ := c.ExternalNetworks("web"); len(nets) != 0 {
+		t.Errorf("expected no allowed external networks for web, got %v", nets)
+	}
+}
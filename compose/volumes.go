@@ -1,7 +1,6 @@
 package compose
 
 import (
-	"fmt"
 	"path"
 	"path/filepath"
 	"strings"
@@ -28,13 +27,13 @@ func (c *Compose) AllowedVolumes() error {
 		// plain checks that we never want
 		v1 := path.Clean(v)
 		if strings.HasPrefix(v1, "/etc/") || strings.HasPrefix(v1, "/root/") || strings.HasPrefix(v1, "/dev/") {
-			return fmt.Errorf("illegal volume source path %s", v)
+			return violation("volumes", "illegal volume source path %s", v)
 		}
 
 		ok1 := allowedPath(c.datadir, v)
 		ok2 := allowedPath(c.dir, v)
 		if !ok1 && !ok2 {
-			return fmt.Errorf("volume source path %s does not fall below %q or %q", v, c.datadir, c.dir)
+			return violation("volumes", "volume source path %s does not fall below %q or %q", v, c.datadir, c.dir)
 		}
 	}
 	return nil
@@ -49,7 +48,7 @@ func loadVolumes(file, name string, env []string) ([]string, error) {
 	for _, s := range tp.Services {
 		for _, v := range s.Volumes {
 			if v.Type != types.VolumeTypeBind && v.Type != types.VolumeTypeVolume {
-				return nil, fmt.Errorf("volumes %s:%s, is not of correct type: %s", v.Source, v.Target, v.Type)
+				return nil, violation("volumes", "volumes %s:%s, is not of correct type: %s", v.Source, v.Target, v.Type)
 			}
 			vols = append(vols, v.Source)
 		}
@@ -3,14 +3,96 @@ package conf
 import (
 	"bytes"
 	"fmt"
+	"strings"
 )
 
+// MakeCaddyImport returns a Caddyfile snippet with a site block for each host in the routes of all services.
 func MakeCaddyImport(c *Config) []byte {
+	buf, _ := caddy{}.Import(c.Routes())
+	return buf
+}
+
+// caddy generates a Caddyfile. The output is deterministic: hosts are sorted and the routes of a host go from
+// most to least specific path.
+type caddy struct{}
+
+func (caddy) Labels(string, []*Route) (map[string]map[string]string, error) { return nil, nil }
+
+func (caddy) Import(routes []*Route) ([]byte, error) {
 	out := &bytes.Buffer{}
-	for _, s := range c.Services {
-		for u, target := range s.URLs {
-			fmt.Fprintf(out, "%s {\n\treverse_proxy %s\n}\n", u, target)
+	hosts(routes, func(routes []*Route) { caddySite(out, routes) })
+	return out.Bytes(), nil
+}
+
+// caddySite writes the site block for routes, which are all for the same host, and a block redirecting the
+// aliases of the routes to the host.
+func caddySite(out *bytes.Buffer, routes []*Route) {
+	host, tls := routes[0].Host, hostTLS(routes)
+	fmt.Fprintf(out, "%s {\n", host)
+	if tls != "" {
+		fmt.Fprintf(out, "\ttls %s\n", tls)
+	}
+	if len(routes) == 1 && routes[0].Path == "" {
+		caddyRoute(out, routes[0], 0, "\t")
+	} else {
+		for i, r := range routes {
+			if r.Path == "" {
+				fmt.Fprintf(out, "\thandle {\n")
+			} else {
+				fmt.Fprintf(out, "\thandle %s {\n", r.Path)
+			}
+			caddyRoute(out, r, i, "\t\t")
+			fmt.Fprintf(out, "\t}\n")
+		}
+	}
+	fmt.Fprintf(out, "}\n")
+
+	aliases := aliases(routes)
+	if len(aliases) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "%s {\n", strings.Join(aliases, ", "))
+	if tls != "" {
+		fmt.Fprintf(out, "\ttls %s\n", tls)
+	}
+	fmt.Fprintf(out, "\tredir https://%s{uri} permanent\n}\n", host)
+}
+
+// caddyRoute writes the directives for route r, the i-th route of its host, indented with indent.
+func caddyRoute(out *bytes.Buffer, r *Route, i int, indent string) {
+	if len(r.Encode) > 0 {
+		fmt.Fprintf(out, "%sencode %s\n", indent, strings.Join(r.Encode, " "))
+	}
+	if len(r.Allow) > 0 {
+		fmt.Fprintf(out, "%s@denied%d not remote_ip %s\n", indent, i, strings.Join(r.Allow, " "))
+		fmt.Fprintf(out, "%srespond @denied%d 403\n", indent, i)
+	}
+	if len(r.BasicAuth) > 0 {
+		fmt.Fprintf(out, "%sbasic_auth {\n", indent)
+		for _, u := range sortedKeys(r.BasicAuth) {
+			fmt.Fprintf(out, "%s\t%s %s\n", indent, u, r.BasicAuth[u])
 		}
+		fmt.Fprintf(out, "%s}\n", indent)
+	}
+	for _, k := range sortedKeys(r.ResponseHeaders) {
+		fmt.Fprintf(out, "%sheader %s\n", indent, caddyHeader(k, r.ResponseHeaders[k]))
+	}
+	if len(r.Headers) == 0 {
+		fmt.Fprintf(out, "%sreverse_proxy %s\n", indent, r.Target)
+		return
+	}
+	fmt.Fprintf(out, "%sreverse_proxy %s {\n", indent, r.Target)
+	for _, k := range sortedKeys(r.Headers) {
+		fmt.Fprintf(out, "%s\theader_up %s\n", indent, caddyHeader(k, r.Headers[k]))
+	}
+	fmt.Fprintf(out, "%s}\n", indent)
+}
+
+// caddyHeader returns the arguments of the header directives for header k with value v. A header starting with a
+// "-" is deleted.
+func caddyHeader(k, v string) string {
+	if strings.HasPrefix(k, "-") {
+		return k
 	}
-	return out.Bytes()
+	return k + ` "` + v + `"`
 }
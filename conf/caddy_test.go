@@ -1,6 +1,16 @@
 package conf
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
 
 func TestMakeCaddyImport(t *testing.T) {
 	const conf = `
@@ -21,3 +31,200 @@ urls = { "example.org" = "pla:5005" }
 		t.Logf("expect = %s\ngot = %s\n", expect, string(out))
 	}
 }
+
+func TestMakeCaddyImportRoutes(t *testing.T) {
+	const conf = `
+[[services]]
+name = "web"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/web"
+urls = { "b.example.org" = "web:80" }
+
+[[services.routes]]
+host = "a.example.org"
+target = "web:80"
+aliases = [ "www.a.example.org" ]
+encode = [ "gzip" ]
+tls = "internal"
+
+[[services.routes]]
+host = "a.example.org"
+path = "/api/*"
+target = "api:8080"
+headers = { "X-Real-Host" = "a.example.org", "-Cookie" = "" }
+response_headers = { "Cache-Control" = "no-store" }
+allow = [ "10.0.0.0/8", "192.168.1.1" ]
+basic_auth = { "miek" = "$2a$14$Zkx19XLiW6VYouLHR5NmfOFU0z2GTNmpkT/5qqR7hx4IjWJPDhjvG" }
+`
+	c, err := Parse([]byte(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expect = `a.example.org {
+	tls internal
+	handle /api/* {
+		@denied0 not remote_ip 10.0.0.0/8 192.168.1.1
+		respond @denied0 403
+		basic_auth {
+			miek $2a$14$Zkx19XLiW6VYouLHR5NmfOFU0z2GTNmpkT/5qqR7hx4IjWJPDhjvG
+		}
+		header Cache-Control "no-store"
+		reverse_proxy api:8080 {
+			header_up -Cookie
+			header_up X-Real-Host "a.example.org"
+		}
+	}
+	handle {
+		encode gzip
+		reverse_proxy web:80
+	}
+}
+www.a.example.org {
+	tls internal
+	redir https://a.example.org{uri} permanent
+}
+b.example.org {
+	reverse_proxy web:80
+}
+`
+	for i := 0; i < 5; i++ { // map iteration order must not matter
+		if out := MakeCaddyImport(c); expect != string(out) {
+			t.Fatalf("generated output doesn't match expected\nexpect = %s\ngot = %s\n", expect, out)
+		}
+	}
+}
+
+func TestRoutesBad(t *testing.T) {
+	for _, route := range []string{
+		`host = "a.example.org"` + "\n" + `target = "web"`,
+		`host = "a.example.org"` + "\n" + `target = "web:80"` + "\n" + `path = "api"`,
+		`host = "a.example.org"` + "\n" + `target = "web:80"` + "\n" + `allow = [ "10.0.0.0/33" ]`,
+		`host = "a.example.org"` + "\n" + `target = "web:80"` + "\n" + `basic_auth = { "miek" = "plain" }`,
+		`host = "a.example.org"` + "\n" + `target = "web:80"` + "\n" + `encode = [ "br" ]`,
+		`host = "a.example.org"` + "\n" + `target = "web:80"` + "\n" + `tls = "off"`,
+		`host = "b.example.org"` + "\n" + `target = "web:80"`, // duplicate of the url
+	} {
+		conf := `
+[[services]]
+name = "web"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/web"
+urls = { "b.example.org" = "web:80" }
+
+[[services.routes]]
+` + route + "\n"
+		if _, err := Parse([]byte(conf)); err == nil {
+			t.Errorf("expected error for route %q", route)
+		}
+	}
+}
+
+// fakeCaddy is a stand-in for Caddy's admin API, it adapts a Caddyfile by wrapping it in JSON as the http app and
+// refuses Caddyfiles with "bad" in them.
+type fakeCaddy struct {
+	mu     sync.Mutex
+	config []byte
+	loads  int
+}
+
+func (f *fakeCaddy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	switch r.URL.Path {
+	case "/adapt":
+		if bytes.Contains(body, []byte("bad")) {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":"unrecognized directive: bad"}`)
+			return
+		}
+		srv := map[string]any{"servers": map[string]any{"srv0": map[string]string{"caddyfile": string(body)}}}
+		buf, _ := json.Marshal(map[string]any{"result": map[string]any{"apps": map[string]any{"http": srv}}})
+		w.Write(buf)
+	case "/config/":
+		if f.config == nil {
+			io.WriteString(w, "null")
+			return
+		}
+		w.Write(f.config)
+	case "/load":
+		f.config = body
+		f.loads++
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestCaddyLoad(t *testing.T) {
+	f := &fakeCaddy{}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	const good = "example.org {\n\treverse_proxy pla:5005\n}\n"
+	for i, expect := range []bool{true, false} {
+		loaded, err := caddyLoad(srv.URL, []byte(good))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded != expect {
+			t.Errorf("push %d: expected loaded to be %t, got %t", i, expect, loaded)
+		}
+	}
+	if _, err := caddyLoad(srv.URL, []byte("example.org {\n\tbad\n}\n")); err == nil {
+		t.Fatal("expected error for bad config")
+	}
+	if f.loads != 1 || !bytes.Contains(f.config, []byte("pla:5005")) {
+		t.Errorf("expected the previous config to be kept, got %d loads and %s", f.loads, f.config)
+	}
+}
+
+func TestCaddyLoadKeepsAdmin(t *testing.T) {
+	f := &fakeCaddy{config: []byte(`{"admin":{"listen":"unix//run/caddy/admin.sock"},"apps":{"http":{"servers":{"old":{}}},"pki":{}}}`)}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	if _, err := caddyLoad(srv.URL, []byte("example.org {\n\treverse_proxy pla:5005\n}\n")); err != nil {
+		t.Fatal(err)
+	}
+	cfg := struct {
+		Admin struct {
+			Listen string `json:"listen"`
+		} `json:"admin"`
+		Apps map[string]struct {
+			Servers map[string]any `json:"servers"`
+		} `json:"apps"`
+	}{}
+	if err := json.Unmarshal(f.config, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Admin.Listen != "unix//run/caddy/admin.sock" {
+		t.Errorf("expected the admin listener to be kept, got %q", cfg.Admin.Listen)
+	}
+	if _, ok := cfg.Apps["pki"]; !ok {
+		t.Errorf("expected the pki app to be kept, got %s", f.config)
+	}
+	if _, ok := cfg.Apps["http"].Servers["old"]; ok {
+		t.Errorf("expected the http app to be replaced, got %s", f.config)
+	}
+}
+
+func TestCaddyLoadUnix(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "admin.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeCaddy{}
+	srv := httptest.NewUnstartedServer(f)
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	loaded, err := caddyLoad("unix://"+sock, []byte("example.org {\n\treverse_proxy pla:5005\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded || f.loads != 1 {
+		t.Errorf("expected config to be loaded over the socket, got %t and %d loads", loaded, f.loads)
+	}
+}
@@ -0,0 +1,196 @@
+package conf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/miekg/pgo/logfile"
+	"go.science.ru.nl/log"
+)
+
+// caddyLoad pushes the Caddyfile data to the Caddy admin API at admin. The Caddyfile is first adapted to Caddy's
+// JSON config, which validates it, and merged into the running config, see caddyMerge. That is only loaded when
+// it differs from the running config. When adapting or loading fails, Caddy keeps running its previous config.
+// It returns true if the config is loaded.
+// The admin API is either an http(s) URL or a unix socket as unix:///path/to/admin.sock.
+func caddyLoad(admin string, data []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+	client, admin := caddyClient(admin)
+
+	buf, err := caddyRequest(ctx, client, http.MethodPost, admin+"/adapt", "text/caddyfile", data)
+	if err != nil {
+		return false, fmt.Errorf("adapting config: %s", err)
+	}
+	adapted := struct {
+		Result   json.RawMessage `json:"result"`
+		Warnings []struct {
+			Message string `json:"message"`
+		} `json:"warnings"`
+	}{}
+	if err := json.Unmarshal(buf, &adapted); err != nil {
+		return false, fmt.Errorf("adapting config: %s", err)
+	}
+	for _, w := range adapted.Warnings {
+		log.Warningf("Caddy config warning: %s", w.Message)
+	}
+
+	running, err := caddyRequest(ctx, client, http.MethodGet, admin+"/config/", "", nil)
+	if err != nil {
+		return false, fmt.Errorf("getting config: %s", err)
+	}
+	merged, err := caddyMerge(running, adapted.Result)
+	if err != nil {
+		return false, fmt.Errorf("merging config: %s", err)
+	}
+	if jsonEqual(merged, running) {
+		return false, nil
+	}
+	if _, err := caddyRequest(ctx, client, http.MethodPost, admin+"/load", "application/json", merged); err != nil {
+		return false, fmt.Errorf("loading config: %s", err)
+	}
+	return true, nil
+}
+
+// caddyApps are the apps of Caddy's config that are generated from the import file, see caddyMerge.
+var caddyApps = []string{"http", "tls"}
+
+// caddyMerge merges the adapted config into the running config, because /load replaces all of it. The http and
+// tls apps are taken from adapted, everything else, like the admin listener, logging, storage and other apps,
+// is kept from running. Top level options of adapted are only used when running doesn't have them.
+func caddyMerge(running, adapted []byte) ([]byte, error) {
+	cfg := map[string]json.RawMessage{}
+	if err := json.Unmarshal(running, &cfg); err != nil { // running is null for an empty config, cfg stays empty
+		return nil, err
+	}
+	if cfg == nil {
+		cfg = map[string]json.RawMessage{}
+	}
+	ad := map[string]json.RawMessage{}
+	if err := json.Unmarshal(adapted, &ad); err != nil {
+		return nil, err
+	}
+	for k, v := range ad {
+		if _, ok := cfg[k]; !ok && k != "apps" {
+			cfg[k] = v
+		}
+	}
+
+	apps, adApps := map[string]json.RawMessage{}, map[string]json.RawMessage{}
+	if a, ok := cfg["apps"]; ok {
+		if err := json.Unmarshal(a, &apps); err != nil {
+			return nil, err
+		}
+	}
+	if a, ok := ad["apps"]; ok {
+		if err := json.Unmarshal(a, &adApps); err != nil {
+			return nil, err
+		}
+	}
+	if apps == nil {
+		apps = map[string]json.RawMessage{}
+	}
+	for _, a := range caddyApps {
+		delete(apps, a)
+		if v, ok := adApps[a]; ok {
+			apps[a] = v
+		}
+	}
+	buf, err := json.Marshal(apps)
+	if err != nil {
+		return nil, err
+	}
+	cfg["apps"] = buf
+	return json.Marshal(cfg)
+}
+
+// caddyClient returns the HTTP client and the base URL to use for the admin API at admin. For a unix socket the
+// client dials the socket and the base URL uses 127.0.0.1 as the host, as Caddy checks the Host header and allows
+// that one for sockets.
+func caddyClient(admin string) (*http.Client, string) {
+	sock, ok := strings.CutPrefix(admin, "unix://")
+	if !ok {
+		return http.DefaultClient, strings.TrimSuffix(admin, "/")
+	}
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}
+	return &http.Client{Transport: tr}, "http://127.0.0.1"
+}
+
+// validAdmin returns true if u is a usable admin API: an http(s) URL or a unix socket with an absolute path.
+func validAdmin(u *url.URL) bool {
+	switch u.Scheme {
+	case "http", "https":
+		return u.Host != ""
+	case "unix":
+		return u.Host == "" && path.IsAbs(u.Path)
+	}
+	return false
+}
+
+// caddyRequest does a request to the Caddy admin API and returns the body of the response. An error is returned
+// if the response isn't a 200, it holds the error message from Caddy.
+func caddyRequest(ctx context.Context, client *http.Client, method, url, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := struct {
+			Error string `json:"error"`
+		}{}
+		if json.Unmarshal(buf, &e) == nil && e.Error != "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return buf, nil
+}
+
+// jsonEqual returns true if a and b hold the same JSON value.
+func jsonEqual(a, b []byte) bool {
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// loadProxy pushes the import file of the service to Caddy's admin API, see caddyLoad.
+func (s *Service) loadProxy() {
+	loaded, err := caddyLoad(s.Admin, s.importdata)
+	if err != nil {
+		log.Warningf("[%s]: Failed to push config to Caddy, keeping the previous one: %v", s.Name, err)
+		logfile.Logger(s.Name, "caddy").Error("config push failed", "error", err.Error())
+		return
+	}
+	if loaded {
+		log.Infof("[%s]: Pushed new config to Caddy", s.Name)
+		logfile.Logger(s.Name, "caddy").Info("config pushed")
+	}
+}
@@ -7,53 +7,106 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
-	"net"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"filippo.io/age"
 	"github.com/compose-spec/compose-go/v2/cli"
 	"github.com/gliderlabs/ssh"
 	"github.com/miekg/pgo/compose"
 	"github.com/miekg/pgo/git"
+	"github.com/miekg/pgo/logfile"
+	"github.com/miekg/pgo/metric"
 	"github.com/miekg/pgo/osutil"
+	"github.com/miekg/pgo/tracing"
 	toml "github.com/pelletier/go-toml/v2"
 	"go.science.ru.nl/log"
 )
 
-const _STOPFILE = ".stop"
+const (
+	_STOPFILE       = ".stop"
+	_KEYFILE        = ".key"         // copy of the deploy key, readable by the service's user
+	_KNOWNHOSTSFILE = ".known_hosts" // copy of the known_hosts, to be used with the deploy key
+	_DOCKERDIR      = ".docker"      // directory holding the DOCKER_CONFIG directory of each service
+	_LOGFILE        = ".log"         // structured log of the service, see package logfile
+	_ENGINEFILE     = ".engine"      // engine and user of the service, to down it when it becomes stale
+	_ROOTLESSDIR    = ".rootless"    // directory holding the pids of the rootless docker daemons we've started
+)
 
 type Service struct {
 	Name        string
 	User        string
 	Repository  string
+	DeployKey   string   `toml:"deploy_key,omitempty"`  // ssh key to access a private repository
+	KnownHosts  string   `toml:"known_hosts,omitempty"` // known_hosts to use with deploy_key
 	Registries  []string // user:token@registry auth
 	ComposeFile string   `toml:"compose,omitempty"` // alternative compose file
 	Branch      string
+	Backend     string            `toml:"git,omitempty"`    // git backend to use: "exec" (default) or "native"
+	Engine      string            `toml:"engine,omitempty"` // container engine: "docker" (default), "docker-rootless" or "podman"
 	Import      string            // filename of caddy file to generate
 	Reload      string            // reload command to use for caddy
+	Admin       string            `toml:"admin,omitempty"` // Caddy admin API to push the import file to, instead of Reload
+	Proxy       string            `toml:"proxy,omitempty"` // reverse proxy to generate the config for, see Proxies
 	Mount       string            // Optional (NFS) mount
-	URLs        map[string]string // url -> host:port
+	URLs        map[string]string // url -> host:port, added to Routes by Parse
+	Routes      []*Route          `toml:"routes,omitempty"` // structured routes for the reverse proxy
 	Env         []string
 	Networks    []string
-	Git         *git.Git         `toml:"-"`
+	Watch       []string         // extra paths (globs) that trigger a redeploy when changed
+	Limits      *Limits          `toml:"limits,omitempty"`    // resource limits for the containers of the service
+	Remediate   *Remediate       `toml:"remediate,omitempty"` // automatic remediation of dying containers
+	Probe       *Probe           `toml:"probe,omitempty"`     // periodic probes of the URLs of the routes
+	Git         git.Repo         `toml:"-"`
 	Compose     *compose.Compose `toml:"-"`
 
-	dir        string   // where is repo checked out
-	datadir    string   // where to find the share
-	importdata []byte   // caddy's import file data
-	reloadcmd  []string // parsed Reload command, should exec service ...
+	dir        string                       // where is repo checked out
+	datadir    string                       // where to find the share
+	importdata []byte                       // caddy's import file data
+	proxied    []*Route                     // routes of all services, for the import file
+	pmu        sync.Mutex                   // protects importdata and proxied, they change on reload
+	dmu        sync.Mutex                   // serializes deploys and remediation of the compose project
+	reloadcmd  []string                     // parsed Reload command, should exec service ...
+	limited    string                       // limits applied to the slice or cgroup the containers run in
+	identity   *age.X25519Identity          // decrypts the secrets file in the repository
+	labels     map[string]map[string]string // labels for the compose services, from the proxy generator
+	labeler    string                       // proxy generating the labels, they're regenerated in checkRoutes
+	ev         events                       // state learned from docker events
+	st         status                       // state of the tracking routine
 }
 
 type Config struct {
-	Services []*Service
+	Engine      string `toml:"engine,omitempty"`       // default container engine for all services
+	CreateUsers bool   `toml:"create_users,omitempty"` // create missing service users
+	Secrets     string `toml:"secrets,omitempty"`      // age encrypted file with secrets, see @secret:
+	Identity    string `toml:"identity,omitempty"`     // age identity (host key) to decrypt Secrets
+	DNS         *DNS   `toml:"dns,omitempty"`          // DNS records for the hosts of the routes
+	Services    []*Service
+
+	sources []string // files the secrets are read from
 }
 
-func Parse(doc []byte) (*Config, error) {
+// Sources returns the files the secrets in the config are read from.
+func (c *Config) Sources() []string { return c.sources }
+
+// serviceName matches the valid service names, they are used in paths, compose project names and systemd units.
+var serviceName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+func Parse(doc []byte) (*Config, error) { return parse(doc, false) }
+
+// ParseCheck parses doc like Parse, but doesn't read the secrets identity, the secrets file and the @file:
+// references, as these are only readable by root. The references are only checked for their syntax and resolve
+// to a placeholder, so the returned config can't be run.
+func ParseCheck(doc []byte) (*Config, error) { return parse(doc, true) }
+
+func parse(doc []byte, check bool) (*Config, error) {
 	c := &Config{}
 	t := toml.NewDecoder(bytes.NewReader(doc))
 	t.DisallowUnknownFields()
@@ -61,6 +114,22 @@ func Parse(doc []byte) (*Config, error) {
 	if err != nil {
 		return c, err
 	}
+	switch c.Engine {
+	case "":
+		c.Engine = osutil.Docker
+	case osutil.Docker, osutil.DockerRootless, osutil.Podman:
+	default:
+		return c, fmt.Errorf("bad engine %q, must be %q, %q or %q", c.Engine, osutil.Docker, osutil.DockerRootless, osutil.Podman)
+	}
+	r, err := newResolver(c.Secrets, c.Identity, check)
+	if err != nil {
+		return c, err
+	}
+	if c.DNS != nil {
+		if err := c.DNS.parse(r); err != nil {
+			return c, fmt.Errorf("bad dns: %s", err)
+		}
+	}
 	uniq := map[string]struct{}{}
 	for _, s := range c.Services {
 		if s == nil {
@@ -69,31 +138,109 @@ func Parse(doc []byte) (*Config, error) {
 		if s.Name == "" || s.User == "" || s.Repository == "" {
 			return c, fmt.Errorf("expect at least name, user and repository for a service")
 		}
+		if !serviceName.MatchString(s.Name) {
+			return c, fmt.Errorf("bad service name %q, must be letters, digits, '_', '.' and '-'", s.Name)
+		}
 		if _, ok := uniq[s.Name]; ok {
 			return c, fmt.Errorf("service name %q is not unique", s.Name)
 		}
 		uniq[s.Name] = struct{}{}
 
-		for u := range s.URLs {
-			if _, err := url.Parse(u); err != nil {
-				return c, fmt.Errorf("bad url %s for service %q", s.Name, u)
+		if err := s.parseRoutes(); err != nil {
+			return c, fmt.Errorf("bad routes for service %q: %s", s.Name, err)
+		}
+		for i := range s.Env {
+			if s.Env[i], err = r.env(s.Env[i]); err != nil {
+				return c, fmt.Errorf("bad env for service %q: %s", s.Name, err)
+			}
+		}
+		for i := range s.Registries {
+			if s.Registries[i], err = r.registry(s.Registries[i]); err != nil {
+				return c, fmt.Errorf("bad registry for service %q: %s", s.Name, err)
 			}
-			if _, _, err := net.SplitHostPort(s.URLs[u]); err != nil {
-				return c, fmt.Errorf("bad service:port %s for service %q", s.Name, s.URLs[u])
+			if _, _, _, err := compose.Auth(s.Registries[i], s.User); err != nil {
+				return c, fmt.Errorf("bad registry for service %q: %s", s.Name, err)
+			}
+		}
+		if s.DeployKey != "" && s.KnownHosts == "" {
+			return c, fmt.Errorf("deploy_key for service %q needs known_hosts", s.Name)
+		}
+		for _, w := range s.Watch {
+			if _, err := path.Match(w, ""); err != nil {
+				return c, fmt.Errorf("bad watch glob %q for service %q: %s", w, s.Name, err)
 			}
 		}
 		if s.Branch == "" {
 			s.Branch = "main"
 		}
-		if s.Import != "" {
-			s.importdata = MakeCaddyImport(c)
+		switch s.Engine {
+		case "":
+			s.Engine = c.Engine
+		case osutil.Docker, osutil.DockerRootless, osutil.Podman:
+		default:
+			return c, fmt.Errorf("bad engine %q for service %q, must be %q, %q or %q", s.Engine, s.Name, osutil.Docker, osutil.DockerRootless, osutil.Podman)
+		}
+		if s.Engine == osutil.DockerRootless && s.User == "root" {
+			return c, fmt.Errorf("service %q can not use engine %q as root", s.Name, osutil.DockerRootless)
+		}
+		if s.Limits != nil {
+			if s.Engine != osutil.Docker {
+				return c, fmt.Errorf("limits for service %q are only supported with engine %q", s.Name, osutil.Docker)
+			}
+			if err := s.Limits.parse(); err != nil {
+				return c, fmt.Errorf("bad limits for service %q: %s", s.Name, err)
+			}
+		}
+		if s.Remediate != nil {
+			if err := s.Remediate.parse(); err != nil {
+				return c, fmt.Errorf("bad remediate for service %q: %s", s.Name, err)
+			}
+		}
+		if s.Probe != nil {
+			if err := s.Probe.parse(); err != nil {
+				return c, fmt.Errorf("bad probe for service %q: %s", s.Name, err)
+			}
+		}
+		switch s.Backend {
+		case "":
+			s.Backend = "exec"
+		case "exec", "native":
+		default:
+			return c, fmt.Errorf("bad git backend %q for service %q, must be %q or %q", s.Backend, s.Name, "exec", "native")
 		}
-		if s.Import != "" && s.Reload == "" {
+		if s.Import != "" && s.Reload == "" && s.Admin == "" {
 			// ret error?
-			log.Errorf("[%s]: Import is set, but there is no reload command", s.Name)
+			log.Errorf("[%s]: Import is set, but there is no reload command or admin API", s.Name)
+		}
+		switch {
+		case s.Proxy == "" && s.Import != "":
+			s.Proxy = "caddy"
+		case s.Proxy == "":
+		case Proxies[s.Proxy] == nil:
+			return c, fmt.Errorf("bad proxy %q for service %q", s.Proxy, s.Name)
+		case s.Proxy == "traefik" && s.Import != "":
+			return c, fmt.Errorf("import for service %q is not used with proxy %q", s.Name, s.Proxy)
+		case s.Proxy != "traefik" && s.Import == "":
+			return c, fmt.Errorf("proxy %q for service %q needs import", s.Proxy, s.Name)
+		}
+		if s.Admin != "" {
+			if s.Proxy != "caddy" {
+				return c, fmt.Errorf("admin for service %q needs proxy %q", s.Name, "caddy")
+			}
+			if s.Import == "" {
+				return c, fmt.Errorf("admin for service %q needs import", s.Name)
+			}
+			if s.Reload != "" {
+				return c, fmt.Errorf("admin and reload for service %q are mutually exclusive", s.Name)
+			}
+			if u, err := url.Parse(s.Admin); err != nil || !validAdmin(u) {
+				return c, fmt.Errorf("bad admin %q for service %q, must be an http, https or unix URL", s.Admin, s.Name)
+			}
 		}
-		if s.Mount != "" && !strings.HasPrefix(s.Mount, "nfs://") {
-			return c, fmt.Errorf("bad mount, must start with nfs://")
+		if s.Mount != "" {
+			if u, err := url.Parse(s.Mount); err != nil || u.Scheme != "nfs" || u.Host == "" || u.Path == "" {
+				return c, fmt.Errorf("bad mount %q for service %q, must be nfs://server/share", s.Mount, s.Name)
+			}
 		}
 		if s.Reload != "" {
 			reloadcmd, reloadname := "", ""
@@ -112,22 +259,51 @@ func Parse(doc []byte) (*Config, error) {
 			s.reloadcmd = append(s.reloadcmd, strings.Fields(reloadcmd)...)
 		}
 	}
+	c.sources = r.sources
+	// after all routes are parsed
+	if err := uniqueHosts(c.Services); err != nil {
+		return c, err
+	}
+	routes := c.Routes()
+	for _, s := range c.Services {
+		if s.Proxy == "" {
+			continue
+		}
+		g := Proxies[s.Proxy]
+		s.proxied = routes
+		if s.importdata, err = g.Import(routes); err != nil {
+			return c, fmt.Errorf("bad routes for proxy %q of service %q: %s", s.Proxy, s.Name, err)
+		}
+		for _, t := range c.Services {
+			labels, err := g.Labels(t.Name, t.Routes)
+			if err != nil {
+				return c, fmt.Errorf("bad routes for proxy %q of service %q: %s", s.Proxy, s.Name, err)
+			}
+			if len(labels) > 0 {
+				t.labeler = s.Proxy
+			}
+			for svc, l := range labels {
+				if t.labels == nil {
+					t.labels = map[string]map[string]string{}
+				}
+				t.labels[svc] = l
+			}
+		}
+	}
 
 	return c, nil
 }
 
-// Stale checks the directory for service subdirs and substracts the current service from it, and then
-// downs the compose service and then removes the directory (recursively).
-// a slice of stale services that can be downed and removed.
-func Stale(sx []*Service, dir string) error {
+// staleNames returns the names of the service directories in dir of services not in sx.
+func staleNames(sx []*Service, dir string) ([]string, error) {
 	ex, err := os.ReadDir(dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
+	names := []string{}
 Stale:
 	for _, e := range ex {
-		if !e.IsDir() {
+		if !e.IsDir() || isStateDir(e.Name()) {
 			continue
 		}
 		for i := range sx {
@@ -135,28 +311,82 @@ Stale:
 				continue Stale
 			}
 		}
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
+
+// Stale checks the directory for service subdirs and substracts the current service from it, and then
+// downs the compose service and then removes the directory (recursively).
+// a slice of stale services that can be downed and removed. They are downed with the engine and as the user they
+// were running with, as recorded in their engine file, engine is used (as root) when that isn't known.
+// Users created by CreateUsers that are no longer used by any service are removed as well, and DNS records
+// published for the stale services are withdrawn from d's server (d may be nil).
+func Stale(sx []*Service, dir, engine string, d *DNS) error {
+	names, err := staleNames(sx, dir)
+	if err != nil {
+		return err
+	}
 
+	for _, name := range names {
 		// TODO(miek): look for /datadir/<service> and umount
 
 		// If the (now deleted) compose config references a non-standard compose, this dance will fail.
 		// We _could_ scan for compose variants and pick one... even that would fail, because there can because
 		// multiple...
-		fulldir := path.Join(dir, e.Name())
-		comp := compose.New(e.Name(), "root", fulldir, "", "", nil, nil, nil, "")
-		if _, err := comp.Stop(nil); err != nil {
-			log.Infof("[%s]: Trying to stop (stale) service %q: %s", e.Name(), e.Name(), err)
+		fulldir := path.Join(dir, name)
+		comp := staleCompose(name, fulldir, engine)
+		if _, err := comp.Stop(context.TODO(), nil); err != nil {
+			log.Infof("[%s]: Trying to stop (stale) service %q: %s", name, name, err)
 		}
-		if _, err := comp.Down(nil); err != nil {
-			log.Infof("[%s]: Trying to down (stale) service %q: %s", e.Name(), e.Name(), err)
+		if _, err := comp.Down(context.TODO(), nil); err != nil {
+			log.Infof("[%s]: Trying to down (stale) service %q: %s", name, name, err)
 		}
-		log.Infof("[%s]: Removing directory: %s", e.Name(), fulldir)
+		d.withdraw(name, fulldir+_DNSFILE)
+		log.Infof("[%s]: Removing directory: %s", name, fulldir)
 		os.RemoveAll(fulldir)
+		os.Remove(fulldir + _KEYFILE)
+		os.Remove(fulldir + _KNOWNHOSTSFILE)
+		os.Remove(fulldir + _AGEKEYFILE)
+		os.Remove(fulldir + _ENGINEFILE)
+		os.Remove(fulldir + compose.OverrideFile)
+		logfile.Remove(fulldir + _LOGFILE)
+		os.RemoveAll(path.Join(dir, _DOCKERDIR, name))
+		removeLimits(name)
 	}
 
-	return nil
+	users := []string{}
+	for i := range sx {
+		if sx[i].Engine == osutil.DockerRootless {
+			users = append(users, sx[i].User)
+		}
+	}
+	err = osutil.StaleRootless(users, path.Join(dir, _ROOTLESSDIR))
+	staleUsers(sx, dir) // after the rootless daemons are stopped, as they run as those users
+	return err
+}
+
+// staleCompose returns a Compose for the stale service name checked out in fulldir, that runs with the engine
+// and as the user recorded in fulldir's engine file. If there is no such file (or the user is gone) the compose
+// runs as root with engine.
+func staleCompose(name, fulldir, engine string) *compose.Compose {
+	u := "root"
+	if buf, err := os.ReadFile(fulldir + _ENGINEFILE); err == nil {
+		if fs := strings.Fields(string(buf)); len(fs) == 2 {
+			if uid, _ := osutil.User(fs[1]); uid != 0 {
+				engine, u = fs[0], fs[1]
+			}
+		}
+	}
+	comp := compose.New(name, u, fulldir, "", "", nil, nil, nil, "")
+	if engine != osutil.Docker {
+		comp.SetRunner(compose.NewCLI(engine, osutil.Socket(u, engine)))
+	}
+	return comp
 }
 
-func (s *Service) InitGitAndCompose(dir, datadir string) error {
+func (s *Service) InitGitAndCompose(ctx context.Context, dir, datadir string) error {
+	dockerdir := path.Join(dir, _DOCKERDIR)
 	dir = path.Join(dir, s.Name)
 	// TODO(miek) +t here?
 	if err := os.MkdirAll(dir, 0777); err != nil { // all users (possible) in the config, need to access this dir
@@ -168,6 +398,9 @@ func (s *Service) InitGitAndCompose(dir, datadir string) error {
 		return err
 	}
 	log.Infof("[%s]: Created git and data dir: %q, %q", s.Name, dir, datadir)
+	if err := logfile.Register(s.Name, dir+_LOGFILE); err != nil {
+		return err
+	}
 	if os.Geteuid() == 0 {
 		// chown last path to correct user
 		uid, gid := osutil.User(s.User)
@@ -180,13 +413,91 @@ func (s *Service) InitGitAndCompose(dir, datadir string) error {
 		}
 	}
 
-	s.Git = git.New(s.Name, s.Repository, s.User, s.Branch, dir)
+	key, knownhosts := "", ""
+	if s.DeployKey != "" {
+		if err := s.installDeployKey(dir); err != nil {
+			return err
+		}
+		key, knownhosts = dir+_KEYFILE, dir+_KNOWNHOSTSFILE
+	} else {
+		os.Remove(dir + _KEYFILE)
+		os.Remove(dir + _KNOWNHOSTSFILE)
+	}
+
+	id, err := loadIdentity(dir + _AGEKEYFILE)
+	if err != nil {
+		return err
+	}
+	s.identity = id
+	log.Infof("[%s]: Secrets in %q must be encrypted to %q", s.Name, _SECRETSFILE, s.Recipient())
+
+	switch s.Backend {
+	case "native":
+		s.Git = git.NewNative(s.Name, s.Repository, s.User, s.Branch, dir, key, knownhosts)
+	default:
+		s.Git = git.New(s.Name, s.Repository, s.User, s.Branch, dir, key, knownhosts)
+	}
 	s.Compose = compose.New(s.Name, s.User, dir, s.ComposeFile, datadir, s.Registries, s.Networks, s.Env, s.Mount)
+	if s.Engine != osutil.Docker {
+		s.Compose.SetRunner(compose.NewCLI(s.Engine, osutil.Socket(s.User, s.Engine)))
+	}
+	if err := os.WriteFile(dir+_ENGINEFILE, []byte(s.Engine+" "+s.User+"\n"), 0644); err != nil {
+		return err
+	}
+	s.Compose.SetLabels(s.labels)
+	s.Compose.SetTargets(s.targets())
+	if s.Limits == nil && len(s.labels) == 0 {
+		os.Remove(dir + compose.OverrideFile)
+	}
+	if err := os.MkdirAll(dockerdir, 0755); err != nil { // all users need to get to their own directory in here
+		return err
+	}
+	s.Compose.SetDockerConfig(path.Join(dockerdir, s.Name))
+	if err := s.Compose.WriteDockerConfig(ctx); err != nil {
+		return err
+	}
+	metric.RegisterContainers(s.Name, s.containerStats)
 	s.dir = dir
 	s.datadir = datadir
 	return nil
 }
 
+// installDeployKey checks that the deploy key is only readable by root, and then copies it and the known_hosts
+// next to dir, owned by the service's user, so git (running as that user) can use them.
+func (s *Service) installDeployKey(dir string) error {
+	info, err := os.Stat(s.DeployKey)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("deploy key %q for service %q is accessible by others: %s", s.DeployKey, s.Name, info.Mode().Perm())
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 && st.Uid != 0 {
+		return fmt.Errorf("deploy key %q for service %q is not owned by root", s.DeployKey, s.Name)
+	}
+
+	uid, gid := osutil.User(s.User)
+	for src, dst := range map[string]string{s.DeployKey: dir + _KEYFILE, s.KnownHosts: dir + _KNOWNHOSTSFILE} {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(dst, data, 0600); err != nil {
+			return err
+		}
+		if err := os.Chmod(dst, 0600); err != nil { // file may have existed with other permissions
+			return err
+		}
+		if os.Geteuid() == 0 {
+			if err := os.Chown(dst, int(uid), int(gid)); err != nil {
+				return err
+			}
+		}
+	}
+	log.Infof("[%s]: Installed deploy key %q", s.Name, s.DeployKey)
+	return nil
+}
+
 // PublicKeys parses the public keys in the ssh/ directory of the repository.
 func (s *Service) PublicKeys() ([]ssh.PublicKey, error) {
 	if s.dir == "" {
@@ -226,6 +537,19 @@ func (s *Service) IsForcedDown() bool {
 	} else {
 		log.Infof("[%s]: Stop file %q exists", s.Name, stop)
 	}
+	down := !errors.Is(err, os.ErrNotExist)
+	if down {
+		metric.ForcedDown.WithLabelValues(s.Name).Set(1)
+	} else {
+		metric.ForcedDown.WithLabelValues(s.Name).Set(0)
+	}
+	return down
+}
+
+// forcedDown returns true if the stop file of s exists, like IsForcedDown, but without logging. It's for the
+// callers that check it often, i.e. on every probe and container event.
+func (s *Service) forcedDown() bool {
+	_, err := os.Stat(s.dir + _STOPFILE)
 	return !errors.Is(err, os.ErrNotExist)
 }
 
@@ -253,19 +577,22 @@ func (s *Service) MountStorage() error {
 
 func (s *Service) Track(ctx context.Context, duration time.Duration) {
 	log.Infof("[%s]: Launched tracking routine for %q", s.Name, s.Name)
+	go s.watchEvents(ctx)
+	go s.probes(ctx)
 
-	err := s.Git.Checkout()
+	err := s.Git.Checkout(ctx)
 	if err != nil {
 		log.Warningf("[%s]: Failed to do check out, will retry: %v", s.Name, err)
+	Checkout:
 		for {
 			select {
 			case <-time.After(jitter(duration)):
-				if err := s.Git.Checkout(); err != nil {
+				if err := s.Git.Checkout(ctx); err != nil {
 					log.Warningf("[%s]: Failed to do check out, will retry: %v", s.Name, err)
 					continue
 				}
 
-				break
+				break Checkout
 
 			case <-ctx.Done():
 				return
@@ -273,17 +600,20 @@ func (s *Service) Track(ctx context.Context, duration time.Duration) {
 		}
 	}
 	log.Infof("[%s]: Succeeded with check out", s.Name)
+	tctx, span := tracing.Begin(ctx, s.Name, "track")
 
 	if err := s.MountStorage(); err != nil {
 		log.Errorf("[%s]: Failed to mount %q: %s", s.Name, s.Mount, err)
 	}
 
 	var errok error
-	if _, err := s.Git.Pull(nil); err != nil {
+	if _, err := s.Git.Pull(tctx, nil); err != nil {
 		log.Warningf("[%s]: Failed to pull: %v", s.Name, err)
 		errok = err
+	} else {
+		s.pulled()
 	}
-	if err := s.Git.Branch(s.Branch); err != nil {
+	if err := s.Git.Branch(tctx, s.Branch); err != nil {
 		log.Warningf("[%s]: Failed to check out branch %s: %v", s.Name, s.Branch, err)
 		errok = err
 	}
@@ -292,55 +622,74 @@ func (s *Service) Track(ctx context.Context, duration time.Duration) {
 		log.Warningf("[%s]: Failed to get public keys: %v", s.Name, err)
 	}
 
+	if err := s.installSecrets(); err != nil {
+		log.Warningf("[%s]: Failed to install secrets: %v", s.Name, err)
+	}
+
 	if errok == nil {
 		log.Infof("[%s]: Checked out git repo in %s for %q (branch %s) with %d configured public keys", s.Name, s.dir, s.Name, s.Branch, len(pubkeys))
 	} else {
 		log.Infof("[%s]: Git repo exist, will fix state in next iteration, last error: %v", s.Name, errok)
 	}
 
-	if err := s.Compose.AllowedExternalNetworks(); err != nil {
+	if err := s.violated(s.Compose.AllowedExternalNetworks()); err != nil {
 		log.Warningf("[%s]: External network usage outside of allowed networks: %v", s.Name, err)
 	}
-	if err := s.Compose.AllowedVolumes(); err != nil {
+	if err := s.violated(s.Compose.AllowedVolumes()); err != nil {
 		log.Warningf("[%s]: Volumes' source outside allowed paths: %v", s.Name, err)
 	}
-	if err := s.Compose.Disallow(); err != nil { // we need a special check for caddy or our proxy container.
+	if err := s.violated(s.Compose.AllowedSecrets()); err != nil {
+		log.Warningf("[%s]: Secrets not from files in allowed paths: %v", s.Name, err)
+	}
+	if err := s.violated(s.Compose.Disallow()); err != nil { // we need a special check for caddy or our proxy container.
 		log.Errorf("[%s]: Disallowed options used, or generic error: %v", s.Name, err)
 	}
+	s.checkRoutes()
 	// Don't make the warnings kill the project this yet.
 
+	s.startEngine()
+	s.limit()
+
+	s.dmu.Lock()
+	start := time.Now()
 	log.Infof("[%s]: Pulling containers", s.Name)
-	if _, err := s.Compose.Pull(nil); err != nil {
+	if _, err := s.Compose.Pull(tctx, nil); err != nil {
 		log.Warningf("[%s]: Failed pulling containers: %v", s.Name, err)
 	}
 	if s.IsForcedDown() {
 		log.Infof("[%s]: Service is forced down, downing to make sure", s.Name)
-		if _, err := s.Compose.Down(nil); err != nil {
+		if _, err := s.Compose.Down(tctx, nil); err != nil {
 			log.Warningf("[%s]: Failed downing services: %v", s.Name, err)
 		}
 	} else {
 		log.Infof("[%s]: Upping services", s.Name)
-		if _, err := s.Compose.Up(nil); err != nil {
+		_, err := s.Compose.Up(tctx, nil)
+		if err != nil {
 			log.Warningf("[%s]: Failed upping services: %v", s.Name, err)
 		}
+		if err == nil {
+			err = s.probeDeploy(tctx)
+		}
+		s.deployed(start, err)
 	}
+	s.dmu.Unlock()
+	s.containerStates()
+	s.st.mu.Lock()
+	s.st.ready = true
+	s.st.mu.Unlock()
 	log.Infof("[%s]: Tracking upstream from %q", s.Name, s.Git.Hash())
 
 	if s.Import != "" {
-		name := path.Join(s.dir, s.Import)
-		log.Infof("[%s]: Writing Caddy import file %q", s.Name, s.Import)
-		os.WriteFile(name, s.importdata, 0644) // with 644 we shouldn't care about ownership
-
-		log.Infof("[%s]: Reloading Caddy", s.Name)
-		if _, err := s.Compose.Exec(s.reloadcmd); err != nil {
-			log.Warningf("[%s]: Failed exec reload command: %v", s.Name, err)
-		}
+		s.updateImport(tctx, true)
 	}
+	tracing.End(span, s.Git.Hash())
 
-	namesOfInterest := cli.DefaultFileNames
+	namesOfInterest := append([]string{}, cli.DefaultFileNames...)
 	if s.ComposeFile != "" {
-		namesOfInterest = []string{"s.ComposeFile"}
+		namesOfInterest = []string{s.ComposeFile}
 	}
+	namesOfInterest = append(namesOfInterest, _SECRETSFILE)
+	namesOfInterest = append(namesOfInterest, s.Watch...)
 	for {
 		select {
 		case <-time.After(jitter(duration)):
@@ -348,90 +697,150 @@ func (s *Service) Track(ctx context.Context, duration time.Duration) {
 			return
 		}
 
-		if s.IsForcedDown() {
-			log.Infof("[%s]: Service is forced down, downing to make sure", s.Name)
-			if _, err := s.Compose.Down(nil); err != nil {
-				log.Warningf("[%s]: Failed downing services: %v", s.Name, err)
-			}
-			continue
-		}
+		uctx, span := tracing.Begin(ctx, s.Name, "track")
+		s.update(uctx, namesOfInterest)
+		tracing.End(span, s.Git.Hash())
+	}
+}
 
-		log.Infof("[%s]: Current hash is %q", s.Name, s.Git.Hash())
+// update is a single iteration of Track: it pulls the repository and redeploys the service if any of the files
+// matching namesOfInterest changed. Ctx carries the span of the iteration.
+func (s *Service) update(ctx context.Context, namesOfInterest []string) {
+	s.dmu.Lock()
+	defer s.dmu.Unlock()
 
-		changed, err := s.Git.Pull(namesOfInterest)
-		if err != nil {
-			log.Warningf("[%s]: Failed to pull: %v, deleting repository in %s, and cloning again", s.Name, err, s.Repository)
-			if err := s.Git.RemoveAll(); err != nil {
-				log.Errorf("[%s]: Failed to remove repository: %v", s.Name, err)
-				continue
-			}
-			if err := s.Git.Checkout(); err != nil {
-				log.Warningf("[%s]: Failed to do check out: %v", s.Name, err)
-				continue
-			}
-			changed = true // force action
-		}
-		if !changed {
-			s.Compose.Up(nil) // should be a noop is already running, if not, this hopefully bring the service up
-			continue
+	s.startEngine()
+	s.limit()
+	s.CrashLooping() // updates the metric, even when there are no events
+	if s.Import != "" {
+		s.updateImport(ctx, false)
+	}
+
+	if s.IsForcedDown() {
+		log.Infof("[%s]: Service is forced down, downing to make sure", s.Name)
+		if _, err := s.Compose.Down(ctx, nil); err != nil {
+			log.Warningf("[%s]: Failed downing services: %v", s.Name, err)
 		}
+		s.containerStates()
+		return
+	}
+
+	log.Infof("[%s]: Current hash is %q", s.Name, s.Git.Hash())
 
-		if err := s.Compose.AllowedExternalNetworks(); err != nil {
-			log.Warningf("[%s]: External network usage outside of allowed networks: %v", s.Name, err)
-			//continue
+	changed, err := s.Git.Pull(ctx, namesOfInterest)
+	if err == nil {
+		s.pulled()
+	}
+	if git.IsTransient(err) {
+		log.Warningf("[%s]: Failed to pull: %v, treating as transient error and ignoring", s.Name, err)
+		return
+	}
+	if err != nil {
+		log.Warningf("[%s]: Failed to pull: %v, deleting repository in %s, and cloning again", s.Name, err, osutil.Redact(s.Repository))
+		if err := s.Git.RemoveAll(); err != nil {
+			log.Errorf("[%s]: Failed to remove repository: %v", s.Name, err)
+			return
 		}
-		if err := s.Compose.AllowedVolumes(); err != nil {
-			log.Warningf("[%s]: Volumes' source outside allowed paths: %v", s.Name, err)
-			//continue
+		if err := s.Git.Checkout(ctx); err != nil {
+			log.Warningf("[%s]: Failed to do check out: %v", s.Name, err)
+			return
 		}
-		if err := s.Compose.Disallow(); err != nil && s.User != "root" {
-			log.Errorf("[%s]: Disallowed options used, or generic error: %v", s.Name, err)
-			//continue
+		s.pulled()
+		changed = true // force action
+	}
+	if changed {
+		if err := s.installSecrets(); err != nil {
+			log.Warningf("[%s]: Failed to install secrets: %v", s.Name, err)
 		}
+	}
+	if !changed {
+		s.Compose.Up(ctx, nil) // should be a noop is already running, if not, this hopefully bring the service up
+		s.containerStates()
+		return
+	}
 
-		ex := s.Compose.Extension()
-		if !ex.Reload {
-			log.Infof("[%s]: reload is set to false, not restarting any containers", s.Name)
-		}
+	if err := s.violated(s.Compose.AllowedExternalNetworks()); err != nil {
+		log.Warningf("[%s]: External network usage outside of allowed networks: %v", s.Name, err)
+		//return
+	}
+	if err := s.violated(s.Compose.AllowedVolumes()); err != nil {
+		log.Warningf("[%s]: Volumes' source outside allowed paths: %v", s.Name, err)
+		//return
+	}
+	if err := s.violated(s.Compose.AllowedSecrets()); err != nil {
+		log.Warningf("[%s]: Secrets not from files in allowed paths: %v", s.Name, err)
+		//return
+	}
+	if err := s.violated(s.Compose.Disallow()); err != nil && s.User != "root" {
+		log.Errorf("[%s]: Disallowed options used, or generic error: %v", s.Name, err)
+		//return
+	}
+	s.checkRoutes()
 
-		log.Infof("[%s]: Downing services", s.Name)
-		if _, err := s.Compose.Down(nil); err != nil {
-			log.Warningf("[%s]: Failed downing services: %v", s.Name, err)
-		}
-		log.Infof("[%s]: Upping services", s.Name)
-		if _, err := s.Compose.Up(nil); err != nil {
-			log.Warningf("[%s]: Failed upping services: %v", s.Name, err)
-		}
+	ex := s.Compose.Extension()
+	if !ex.Reload {
+		log.Infof("[%s]: reload is set to false, not restarting any containers", s.Name)
+	}
+
+	start := time.Now()
+	log.Infof("[%s]: Downing services", s.Name)
+	if _, err := s.Compose.Down(ctx, nil); err != nil {
+		log.Warningf("[%s]: Failed downing services: %v", s.Name, err)
 	}
+	log.Infof("[%s]: Upping services", s.Name)
+	_, err = s.Compose.Up(ctx, nil)
+	if err != nil {
+		log.Warningf("[%s]: Failed upping services: %v", s.Name, err)
+	}
+	if err == nil {
+		err = s.probeDeploy(ctx)
+	}
+	s.deployed(start, err)
+	s.containerStates()
 }
 
-// Track will sha1 sum the contents of file and if it differs from previous runs, will SIGHUP ourselves so we
-// exist with status code 2, which in turn will systemd restart us again.
-func Track(ctx context.Context, file string, done chan<- os.Signal) {
+// startEngine starts the rootless docker daemon of the service's user, if the service uses one. If the daemon
+// is already running this is a noop.
+func (s *Service) startEngine() {
+	if s.Engine != osutil.DockerRootless {
+		return
+	}
+	if err := osutil.StartRootless(s.User, path.Join(path.Dir(s.dir), _ROOTLESSDIR)); err != nil {
+		log.Warningf("[%s]: Failed to start rootless docker for %q: %v", s.Name, s.User, err)
+	}
+}
+
+// Track will sha1 sum the contents of files and if it differs from previous runs, will call reload, which reloads
+// the config in-process, see Tracker.Reload. Files returns the config file and the files the secrets are read
+// from, see Config.Sources, so secrets are rotated when they change; it is called on every check as the files
+// may change with the config.
+func Track(ctx context.Context, files func() []string, reload func()) {
 	hash := ""
+Wait:
 	for {
 		select {
 		case <-time.After(30 * time.Second):
 		case <-ctx.Done():
 			return
 		}
-		doc, err := os.ReadFile(file)
-		if err != nil {
-			log.Warningf("Failed to read config %q: %s", file, err)
-			continue
-		}
 		sha := sha1.New()
-		sha.Write(doc)
+		for _, file := range files() {
+			doc, err := os.ReadFile(file)
+			if err != nil {
+				log.Warningf("Failed to read config %q: %s", file, err)
+				continue Wait
+			}
+			sha.Write(doc)
+		}
 		hash1 := string(sha.Sum(nil))
 		if hash == "" {
 			hash = hash1
 			continue
 		}
 		if hash1 != hash {
-			log.Info("Config change detected, sending SIGHUP")
-			// haste our exit (can this block?)
-			done <- syscall.SIGHUP
-			return
+			log.Info("Config change detected, reloading")
+			reload()
+			hash = hash1
 		}
 	}
 }
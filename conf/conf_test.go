@@ -1,7 +1,15 @@
 package conf
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+
+	"filippo.io/age"
+	"github.com/miekg/pgo/osutil"
 )
 
 func TestValidConfig(t *testing.T) {
@@ -35,3 +43,352 @@ urls = { "slashdot.org" = "pla:5005" }
 		t.Fatalf("expected 1 registry, got %d", len(c.Services[0].Registries))
 	}
 }
+
+func TestValidConfigWatch(t *testing.T) {
+	const conf = `
+[[services]]
+name = "bliep"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/bliep"
+watch = [ "config/", "caddy/*.conf" ]
+`
+	c, err := Parse([]byte(conf))
+	if err != nil {
+		t.Fatalf("expected to parse config, but got: %s", err)
+	}
+	if len(c.Services[0].Watch) != 2 {
+		t.Fatalf("expected 2 watch globs, got %d", len(c.Services[0].Watch))
+	}
+
+	const bad = `
+[[services]]
+name = "bliep"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/bliep"
+watch = [ "config/[" ]
+`
+	if _, err := Parse([]byte(bad)); err == nil {
+		t.Fatal("expected error for bad watch glob, got none")
+	}
+}
+
+func TestDeployKey(t *testing.T) {
+	const conf = `
+[[services]]
+name = "bliep"
+user = "miekg"
+repository = "git@gitlab.science.ru.nl:bla/bliep"
+deploy_key = "/etc/pgo/bliep"
+`
+	if _, err := Parse([]byte(conf)); err == nil {
+		t.Fatal("expected error for deploy_key without known_hosts, got none")
+	}
+
+	dir := t.TempDir()
+	s := &Service{Name: "bliep", User: "root", DeployKey: filepath.Join(dir, "key"), KnownHosts: filepath.Join(dir, "known_hosts")}
+	os.WriteFile(s.DeployKey, []byte("key"), 0644)
+	os.WriteFile(s.KnownHosts, []byte("known_hosts"), 0644)
+	if err := s.installDeployKey(filepath.Join(dir, "bliep")); err == nil {
+		t.Fatal("expected error for world readable deploy key, got none")
+	}
+	os.Chmod(s.DeployKey, 0600)
+	if err := s.installDeployKey(filepath.Join(dir, "bliep")); err != nil {
+		t.Fatalf("expected deploy key to be installed, got: %s", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "bliep"+_KEYFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected installed key to have mode 0600, got %s", info.Mode().Perm())
+	}
+}
+
+func TestEngine(t *testing.T) {
+	const conf = `
+engine = "podman"
+
+[[services]]
+name = "bliep"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/bliep"
+
+[[services]]
+name = "bloep"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/bloep"
+engine = "docker"
+`
+	c, err := Parse([]byte(conf))
+	if err != nil {
+		t.Fatalf("expected to parse config, but got: %s", err)
+	}
+	if c.Services[0].Engine != "podman" {
+		t.Errorf("expected engine %q, got %q", "podman", c.Services[0].Engine)
+	}
+	if c.Services[1].Engine != "docker" {
+		t.Errorf("expected engine %q, got %q", "docker", c.Services[1].Engine)
+	}
+
+	if _, err := Parse([]byte(`engine = "rkt"`)); err == nil {
+		t.Fatal("expected error for bad engine, got none")
+	}
+
+	const root = `
+[[services]]
+name = "bliep"
+user = "root"
+repository = "https://gitlab.science.ru.nl/bla/bliep"
+engine = "docker-rootless"
+`
+	if _, err := Parse([]byte(root)); err == nil {
+		t.Fatal("expected error for rootless docker as root, got none")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	const conf = `
+[[services]]
+name = "bliep"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/bliep"
+[services.limits]
+cpu = "150%"
+memory = "512M"
+io_weight = 200
+`
+	c, err := Parse([]byte(conf))
+	if err != nil {
+		t.Fatalf("expected to parse config, but got: %s", err)
+	}
+	l := c.Services[0].Limits
+	if x := strings.Join(l.properties(), " "); x != "CPUQuota=150% MemoryMax=512M IOWeight=200" {
+		t.Errorf("expected systemd properties, got %q", x)
+	}
+	f := l.files()
+	if f["cpu.max"] != "150000 100000" || f["memory.max"] != "536870912" || f["io.weight"] != "default 200" {
+		t.Errorf("expected cgroup files, got %v", f)
+	}
+
+	for good, bad := range map[string]string{`cpu = "150%"`: `cpu = "1.5"`, `memory = "512M"`: `memory = "512MB"`, `io_weight = 200`: `io_weight = 20000`} {
+		if _, err := Parse([]byte(strings.Replace(conf, good, bad, 1))); err == nil {
+			t.Errorf("expected error for %s, got none", bad)
+		}
+	}
+	if _, err := Parse([]byte(strings.Replace(conf, "[services.limits]", "engine = \"podman\"\n[services.limits]", 1))); err == nil {
+		t.Error("expected error for limits with podman, got none")
+	}
+	if _, err := Parse([]byte(strings.Replace(conf, `name = "bliep"`, `name = "../bliep"`, 1))); err == nil {
+		t.Error("expected error for bad service name, got none")
+	}
+	if x := sliceName("bliep-bloep"); x != `pgo-bliep\x2dbloep.slice` {
+		t.Errorf("expected escaped slice name, got %q", x)
+	}
+}
+
+func TestStaleKeepsHomes(t *testing.T) {
+	dir := t.TempDir()
+	defer func(rd string) { osutil.RuntimeDir = rd }(osutil.RuntimeDir)
+	osutil.RuntimeDir = t.TempDir()
+	os.MkdirAll(filepath.Join(dir, _HOMEDIR, "pgo-test-nonexistent"), 0755)
+	os.MkdirAll(filepath.Join(dir, "bliep"), 0755)
+
+	c, err := Parse([]byte("create_users = true\n[[services]]\nname = \"bliep\"\nuser = \"pgo-test-nonexistent\"\nrepository = \"https://gitlab.science.ru.nl/bla/bliep\"\n"))
+	if err != nil {
+		t.Fatalf("expected to parse config, but got: %s", err)
+	}
+	if !c.CreateUsers {
+		t.Error("expected create_users to be set")
+	}
+	if err := Stale(c.Services, dir, c.Engine, c.DNS); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{_HOMEDIR, "bliep"} {
+		if _, err := os.Stat(filepath.Join(dir, d)); err != nil {
+			t.Errorf("expected %q to be kept, got %s", d, err)
+		}
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	dir := t.TempDir()
+	id, _ := age.GenerateX25519Identity()
+	os.WriteFile(filepath.Join(dir, "host.key"), []byte(id.String()+"\n"), 0600)
+	buf := &bytes.Buffer{}
+	w, _ := age.Encrypt(buf, id.Recipient())
+	w.Write([]byte("# registry\nREGTOKEN=s3@cr3t\n"))
+	w.Close()
+	os.WriteFile(filepath.Join(dir, "secrets.age"), buf.Bytes(), 0644)
+	os.WriteFile(filepath.Join(dir, "db"), []byte("hunter2\n"), 0600)
+
+	conf := `
+secrets = "` + filepath.Join(dir, "secrets.age") + `"
+identity = "` + filepath.Join(dir, "host.key") + `"
+
+[[services]]
+name = "bliep"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/bliep"
+env = [ "DB_PASS=@file:` + filepath.Join(dir, "db") + `", "PLAIN=plain" ]
+registries = [ "miek:@secret:REGTOKEN@registry.example.org", "@secret:REGTOKEN@other.example.org" ]
+`
+	c, err := Parse([]byte(conf))
+	if err != nil {
+		t.Fatalf("expected to parse config, but got: %s", err)
+	}
+	s := c.Services[0]
+	if s.Env[0] != "DB_PASS=hunter2" || s.Env[1] != "PLAIN=plain" {
+		t.Errorf("expected resolved env, got %v", s.Env)
+	}
+	if s.Registries[0] != "miek:s3@cr3t@registry.example.org" || s.Registries[1] != "s3@cr3t@other.example.org" {
+		t.Errorf("expected resolved registries, got %v", s.Registries)
+	}
+	if len(c.Sources()) != 3 {
+		t.Errorf("expected 3 sources, got %v", c.Sources())
+	}
+
+	if _, err := Parse([]byte(strings.Replace(conf, "@secret:REGTOKEN@registry", "@secret:NOPE@registry", 1))); err == nil {
+		t.Error("expected error for unknown secret, got none")
+	}
+	os.Chmod(filepath.Join(dir, "host.key"), 0644)
+	if _, err := Parse([]byte(conf)); err == nil {
+		t.Error("expected error for identity accessible by others, got none")
+	}
+
+	// nothing is read when checking
+	unreadable := strings.ReplaceAll(conf, dir, "/nonexistent")
+	if _, err := Parse([]byte(unreadable)); err == nil {
+		t.Error("expected error for unreadable secrets, got none")
+	}
+	if _, err := ParseCheck([]byte(unreadable)); err != nil {
+		t.Errorf("expected check to parse config, but got: %s", err)
+	}
+	for _, bad := range []string{"@file:db", "@secret:"} {
+		if _, err := ParseCheck([]byte(strings.Replace(unreadable, "@file:/nonexistent/db", bad, 1))); err == nil {
+			t.Errorf("expected error for %q, got none", bad)
+		}
+	}
+}
+
+func TestInstallSecrets(t *testing.T) {
+	dir := t.TempDir()
+	s := &Service{Name: "bliep", User: "root", dir: filepath.Join(dir, "bliep"), datadir: filepath.Join(dir, "data")}
+	os.MkdirAll(s.dir, 0755)
+	if err := s.installSecrets(); err != nil {
+		t.Fatalf("expected no error without secrets file, got %s", err)
+	}
+
+	id, err := loadIdentity(s.dir + _AGEKEYFILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.identity = id
+	if id1, _ := loadIdentity(s.dir + _AGEKEYFILE); id1.String() != id.String() {
+		t.Fatal("expected identity to be loaded again, got a new one")
+	}
+
+	encrypt := func(plain string) {
+		buf := &bytes.Buffer{}
+		w, _ := age.Encrypt(buf, id.Recipient())
+		w.Write([]byte(plain))
+		w.Close()
+		os.WriteFile(filepath.Join(s.dir, _SECRETSFILE), buf.Bytes(), 0644)
+	}
+	encrypt("DB_PASS=hunter2\nAPI_KEY=s3cr3t\n")
+	if err := s.installSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(s.datadir, _SECRETSDIR, "DB_PASS")
+	buf, _ := os.ReadFile(secret)
+	if string(buf) != "hunter2" {
+		t.Errorf("expected secret %q, got %q", "hunter2", buf)
+	}
+	if info, _ := os.Stat(secret); info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode %s, got %s", os.FileMode(0600), info.Mode().Perm())
+	}
+
+	target := filepath.Join(dir, "shadow")
+	os.WriteFile(target, []byte("root only"), 0600)
+	os.Remove(secret)
+	os.Symlink(target, secret)
+	encrypt("DB_PASS=hunter3\n")
+	if err := s.installSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := os.ReadFile(target); string(buf) != "root only" {
+		t.Errorf("expected symlink target to be untouched, got %q", buf)
+	}
+	if buf, _ := os.ReadFile(secret); string(buf) != "hunter3" {
+		t.Errorf("expected secret %q, got %q", "hunter3", buf)
+	}
+	if _, err := os.Stat(filepath.Join(s.datadir, _SECRETSDIR, "API_KEY")); err == nil {
+		t.Error("expected removed secret to be deleted")
+	}
+
+	encrypt("../escape=x\n")
+	if err := s.installSecrets(); err == nil {
+		t.Error("expected error for bad secret name, got none")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	const conf = `
+[[services]]
+name = "a"
+user = "root"
+repository = "https://gitlab.science.ru.nl/bla/a"
+
+[[services]]
+name = "b"
+user = "pgo-test-nonexistent"
+repository = "https://gitlab.science.ru.nl/bla/b"
+deploy_key = "/nonexistent/key"
+known_hosts = "/nonexistent/known_hosts"
+`
+	c, err := Parse([]byte(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := c.Check(); len(errs) != 3 {
+		t.Errorf("expected 3 problems, got %v", errs)
+	}
+	c.CreateUsers = true
+	if errs := c.Check(); len(errs) != 2 {
+		t.Errorf("expected 2 problems, got %v", errs)
+	}
+
+	if _, err := Parse([]byte(conf + `mount = "nfs://server"`)); err == nil {
+		t.Errorf("expected error for mount without share")
+	}
+}
+
+func TestPlan(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"a", "old", _HOMEDIR} {
+		os.MkdirAll(filepath.Join(dir, d), 0755)
+	}
+	os.WriteFile(filepath.Join(dir, "b"+_STOPFILE), nil, 0644)
+
+	c, err := Parse([]byte(`create_users = true
+[[services]]
+name = "a"
+user = "root"
+repository = "https://gitlab.science.ru.nl/bla/a"
+
+[[services]]
+name = "b"
+user = "pgo-test-nonexistent"
+repository = "https://gitlab.science.ru.nl/bla/b"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.Plan(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := &Plan{Clone: []string{"b"}, Restart: []string{"a"}, Down: []string{"b"}, Stale: []string{"old"}, Users: []string{"pgo-test-nonexistent"}}
+	if !reflect.DeepEqual(p, expect) {
+		t.Errorf("expected plan %+v, got %+v", expect, p)
+	}
+}
@@ -0,0 +1,269 @@
+package conf
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.science.ru.nl/log"
+)
+
+const _DNSFILE = ".dns" // the records published for the service with dynamic updates, to withdraw them
+
+// DNS are the DNS records for the hosts (and aliases) of the routes of all services. They point to this
+// machine and are either written to a zone file fragment or send as dynamic updates (RFC 2136) to the
+// authoritative server of the zone.
+type DNS struct {
+	Zone          string   `toml:"zone"`                     // only hosts in this zone get records
+	Host          string   `toml:"host,omitempty"`           // name of this machine for the CNAME records, the hostname by default
+	Addresses     []string `toml:"addresses,omitempty"`      // addresses of this machine, for A and AAAA records instead of CNAMEs
+	TTL           uint32   `toml:"ttl,omitempty"`            // TTL of the records, 300 by default
+	File          string   `toml:"file,omitempty"`           // write the records to this zone file fragment
+	Server        string   `toml:"server,omitempty"`         // or send dynamic updates to this server
+	TSIGKey       string   `toml:"tsig_key,omitempty"`       // name of the TSIG key for the updates
+	TSIGSecret    string   `toml:"tsig_secret,omitempty"`    // base64 TSIG secret, can be a @secret: or @file: reference
+	TSIGAlgorithm string   `toml:"tsig_algorithm,omitempty"` // TSIG algorithm, "hmac-sha256" by default
+}
+
+func (d *DNS) parse(r *resolver) error {
+	if d.Zone == "" {
+		return fmt.Errorf("zone is required")
+	}
+	if _, ok := dns.IsDomainName(d.Zone); !ok {
+		return fmt.Errorf("bad zone %q", d.Zone)
+	}
+	d.Zone = dns.Fqdn(d.Zone)
+	if (d.File == "") == (d.Server == "") {
+		return fmt.Errorf("need either file or server")
+	}
+	if len(d.Addresses) > 0 && d.Host != "" {
+		return fmt.Errorf("host and addresses can't be used both")
+	}
+	for _, a := range d.Addresses {
+		if _, err := netip.ParseAddr(a); err != nil {
+			return fmt.Errorf("bad address %q", a)
+		}
+	}
+	if len(d.Addresses) == 0 && d.Host == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		d.Host = host
+	}
+	if d.Host != "" {
+		if _, ok := dns.IsDomainName(d.Host); !ok {
+			return fmt.Errorf("bad host %q", d.Host)
+		}
+		d.Host = dns.Fqdn(d.Host)
+	}
+	if d.TTL == 0 {
+		d.TTL = 300
+	}
+	if d.Server != "" {
+		if _, _, err := net.SplitHostPort(d.Server); err != nil {
+			d.Server = net.JoinHostPort(d.Server, "53")
+		}
+	}
+	if d.TSIGKey == "" {
+		if d.TSIGSecret != "" {
+			return fmt.Errorf("tsig_secret needs tsig_key")
+		}
+		return nil
+	}
+	if d.Server == "" {
+		return fmt.Errorf("tsig_key needs server")
+	}
+	d.TSIGKey = dns.Fqdn(d.TSIGKey)
+	if d.TSIGAlgorithm == "" {
+		d.TSIGAlgorithm = "hmac-sha256"
+	}
+	d.TSIGAlgorithm = dns.Fqdn(d.TSIGAlgorithm)
+	switch d.TSIGAlgorithm {
+	case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+	default:
+		return fmt.Errorf("bad tsig_algorithm %q", d.TSIGAlgorithm)
+	}
+	secret, err := r.resolve(d.TSIGSecret)
+	if err != nil {
+		return err
+	}
+	if _, err := base64.StdEncoding.DecodeString(secret); err != nil || secret == "" {
+		return fmt.Errorf("bad tsig_secret, must be base64")
+	}
+	d.TSIGSecret = secret
+	return nil
+}
+
+// records returns the records of the hosts and aliases of the routes of s that are in the zone, sorted.
+func (d *DNS) records(s *Service) []dns.RR {
+	names := map[string]bool{}
+	for _, r := range s.Routes {
+		for _, h := range append([]string{r.Host}, r.Aliases...) {
+			h = dns.Fqdn(strings.ToLower(h))
+			if !dns.IsSubDomain(d.Zone, h) {
+				continue
+			}
+			if h == d.Zone && d.Host != "" {
+				log.Warningf("[%s]: No CNAME record for zone apex %s", s.Name, h)
+				continue
+			}
+			names[h] = true
+		}
+	}
+	rrs := []dns.RR{}
+	for h := range names {
+		hdr := dns.RR_Header{Name: h, Class: dns.ClassINET, Ttl: d.TTL}
+		if d.Host != "" {
+			hdr.Rrtype = dns.TypeCNAME
+			rrs = append(rrs, &dns.CNAME{Hdr: hdr, Target: d.Host})
+			continue
+		}
+		for _, a := range d.Addresses {
+			addr := netip.MustParseAddr(a)
+			if addr.Is4() {
+				hdr.Rrtype = dns.TypeA
+				rrs = append(rrs, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+				continue
+			}
+			hdr.Rrtype = dns.TypeAAAA
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+		}
+	}
+	sort.Slice(rrs, func(i, j int) bool { return rrs[i].String() < rrs[j].String() })
+	return rrs
+}
+
+// Update publishes the records of all services. A zone file fragment is rewritten completely, so records of
+// removed services disappear. With dynamic updates the records of each service are recorded in the <name>.dns
+// file in dir, records that are no longer needed are deleted, see Stale for removed services.
+func (d *DNS) Update(sx []*Service, dir string) error {
+	if d.File != "" {
+		buf := &strings.Builder{}
+		fmt.Fprintf(buf, "; generated by pgod, do not edit\n")
+		for _, s := range sx {
+			for _, rr := range d.records(s) {
+				fmt.Fprintln(buf, rr.String())
+			}
+		}
+		log.Infof("Writing DNS records to %q", d.File)
+		return os.WriteFile(d.File, []byte(buf.String()), 0644)
+	}
+
+	for _, s := range sx {
+		file := path.Join(dir, s.Name) + _DNSFILE
+		old, err := readRecords(file)
+		if err != nil {
+			log.Warningf("[%s]: Failed to read published DNS records: %v", s.Name, err)
+		}
+		rrs := d.records(s)
+		if len(old) == 0 && len(rrs) == 0 {
+			continue
+		}
+		m := &dns.Msg{}
+		m.SetUpdate(d.Zone)
+		for _, rr := range old {
+			if !hasRecord(rrs, rr) {
+				m.Remove([]dns.RR{rr})
+			}
+		}
+		m.Insert(rrs)
+		if err := d.exchange(m); err != nil {
+			log.Warningf("[%s]: Failed to update DNS records: %v", s.Name, err)
+			continue
+		}
+		log.Infof("[%s]: Updated %d DNS records in %s", s.Name, len(rrs), d.Zone)
+		if len(rrs) == 0 {
+			os.Remove(file)
+			continue
+		}
+		if err := writeRecords(file, rrs); err != nil {
+			log.Warningf("[%s]: Failed to record published DNS records: %v", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// withdraw deletes the records published for the removed service name, that are recorded in file.
+func (d *DNS) withdraw(name, file string) {
+	old, err := readRecords(file)
+	if err != nil {
+		log.Warningf("[%s]: Failed to read published DNS records: %v", name, err)
+		return
+	}
+	if len(old) == 0 {
+		return
+	}
+	if d == nil || d.Server == "" {
+		log.Warningf("[%s]: Can't withdraw %d DNS records without a DNS server", name, len(old))
+		os.Remove(file)
+		return
+	}
+	m := &dns.Msg{}
+	m.SetUpdate(d.Zone)
+	m.Remove(old)
+	if err := d.exchange(m); err != nil {
+		log.Warningf("[%s]: Failed to withdraw DNS records: %v", name, err)
+		return // try again next time
+	}
+	log.Infof("[%s]: Withdrew %d DNS records from %s", name, len(old), d.Zone)
+	os.Remove(file)
+}
+
+// exchange sends the update m to the server, signed with TSIG when configured.
+func (d *DNS) exchange(m *dns.Msg) error {
+	c := &dns.Client{Net: "tcp", Timeout: 10 * time.Second}
+	if d.TSIGKey != "" {
+		c.TsigSecret = map[string]string{d.TSIGKey: d.TSIGSecret}
+		m.SetTsig(d.TSIGKey, d.TSIGAlgorithm, 300, time.Now().Unix())
+	}
+	r, _, err := c.Exchange(m, d.Server)
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update refused: %s", dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
+
+func hasRecord(rrs []dns.RR, rr dns.RR) bool {
+	for _, r := range rrs {
+		if dns.IsDuplicate(r, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// readRecords reads the records in file, a non existing file has no records.
+func readRecords(file string) ([]dns.RR, error) {
+	buf, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rrs := []dns.RR{}
+	zp := dns.NewZoneParser(strings.NewReader(string(buf)), "", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	return rrs, zp.Err()
+}
+
+func writeRecords(file string, rrs []dns.RR) error {
+	buf := &strings.Builder{}
+	for _, rr := range rrs {
+		fmt.Fprintln(buf, rr.String())
+	}
+	return os.WriteFile(file, []byte(buf.String()), 0600)
+}
@@ -0,0 +1,182 @@
+package conf
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const dnsConf = `
+[dns]
+zone = "example.org"
+host = "server1.example.org"
+%s
+
+[[services]]
+name = "web"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/web"
+urls = { "a.example.org" = "web:80", "example.net" = "web:80" }
+
+[[services.routes]]
+host = "b.example.org"
+target = "web:80"
+aliases = [ "www.b.example.org" ]
+`
+
+func TestDNSFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pgo.zone")
+	c, err := Parse([]byte(strings.Replace(dnsConf, "%s", `file = "`+file+`"`, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DNS.Update(c.Services, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := os.ReadFile(file)
+	const expect = `; generated by pgod, do not edit
+a.example.org.	300	IN	CNAME	server1.example.org.
+b.example.org.	300	IN	CNAME	server1.example.org.
+www.b.example.org.	300	IN	CNAME	server1.example.org.
+`
+	if string(buf) != expect {
+		t.Errorf("zone file fragment doesn't match expected\nexpect = %s\ngot = %s\n", expect, buf)
+	}
+}
+
+// fakeDNS is an authoritative server that applies the dynamic updates it gets, if they are signed.
+type fakeDNS struct {
+	mu  sync.Mutex
+	rrs []dns.RR
+}
+
+func (f *fakeDNS) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := &dns.Msg{}
+	m.SetReply(r)
+	if r.IsTsig() == nil || w.TsigStatus() != nil {
+		m.Rcode = dns.RcodeNotAuth
+		w.WriteMsg(m)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, rr := range r.Ns {
+		if rr.Header().Class == dns.ClassNONE {
+			rr = dns.Copy(rr)
+			rr.Header().Class = dns.ClassINET
+			for i := range f.rrs {
+				if dns.IsDuplicate(f.rrs[i], rr) {
+					f.rrs = append(f.rrs[:i], f.rrs[i+1:]...)
+					break
+				}
+			}
+			continue
+		}
+		if !hasRecord(f.rrs, rr) {
+			f.rrs = append(f.rrs, rr)
+		}
+	}
+	w.WriteMsg(m)
+}
+
+func (f *fakeDNS) names() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := []string{}
+	for _, rr := range f.rrs {
+		names = append(names, rr.Header().Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDNSUpdate(t *testing.T) {
+	const secret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeDNS{}
+	srv := &dns.Server{
+		Listener:      l,
+		Handler:       f,
+		TsigSecret:    map[string]string{"pgo.": secret},
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	update := `server = "` + l.Addr().String() + `"
+tsig_key = "pgo"
+tsig_secret = "` + secret + `"`
+	c, err := Parse([]byte(strings.Replace(dnsConf, "%s", update, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := c.DNS.Update(c.Services, dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(f.names(), " "); got != "a.example.org. b.example.org. www.b.example.org." {
+		t.Fatalf("expected records for all hosts in the zone, got %q", got)
+	}
+
+	// drop a url, its record must go
+	delete(c.Services[0].URLs, "a.example.org")
+	c.Services[0].Routes = c.Services[0].Routes[1:]
+	if err := c.DNS.Update(c.Services, dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(f.names(), " "); got != "b.example.org. www.b.example.org." {
+		t.Fatalf("expected record of dropped url to be deleted, got %q", got)
+	}
+
+	// remove the service, see Stale
+	c.DNS.withdraw("web", filepath.Join(dir, "web")+_DNSFILE)
+	if got := f.names(); len(got) != 0 {
+		t.Fatalf("expected all records to be withdrawn, got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "web") + _DNSFILE); !os.IsNotExist(err) {
+		t.Errorf("expected published records file to be removed, got %v", err)
+	}
+
+	// unsigned updates are refused
+	c.DNS.TSIGKey = ""
+	if err := c.DNS.Update(c.Services, dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.names(); len(got) != 0 {
+		t.Fatalf("expected unsigned update to be refused, got %q", got)
+	}
+}
+
+func TestDNSBad(t *testing.T) {
+	for _, bad := range []string{
+		`zone = "example.org"`,
+		`zone = "example.org"
+file = "x"
+server = "127.0.0.1"`,
+		`zone = "example.org"
+file = "x"
+addresses = [ "192.0.2.300" ]`,
+		`zone = "example.org"
+server = "127.0.0.1"
+tsig_key = "pgo"
+tsig_secret = "not base64!"`,
+		`zone = "example.org"
+server = "127.0.0.1"
+tsig_key = "pgo"
+tsig_secret = "c2VjcmV0"
+tsig_algorithm = "md5"`,
+	} {
+		if _, err := Parse([]byte("[dns]\n" + bad + "\n")); err == nil {
+			t.Errorf("expected error for %q, got none", bad)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package conf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/pgo/compose"
+	"github.com/miekg/pgo/logfile"
+	"github.com/miekg/pgo/metric"
+	"github.com/miekg/pgo/osutil"
+	"github.com/miekg/pgo/tracing"
+	"go.science.ru.nl/log"
+)
+
+// A service is crash looping when its containers died unexpectedly this often within _CRASHLOOPWINDOW.
+const (
+	_CRASHLOOPDIES   = 5
+	_CRASHLOOPWINDOW = 10 * time.Minute
+)
+
+// _EVENTRETRY is the time to wait before subscribing to docker events again, after the connection was lost.
+const _EVENTRETRY = 10 * time.Second
+
+// Remediate configures the automatic remediation of a service's containers. A container that dies is upped
+// again and an unhealthy container is restarted, at most Budget times per Window.
+type Remediate struct {
+	Budget int    `toml:"budget,omitempty"` // number of remediations allowed in window, defaults to 3
+	Window string `toml:"window,omitempty"` // i.e. "1h", the default
+	Notify string `toml:"notify,omitempty"` // URL to POST a JSON notification to, on crash loops and exhausted budgets
+
+	window time.Duration
+}
+
+func (r *Remediate) parse() error {
+	if r.Budget < 0 {
+		return fmt.Errorf("bad budget %d, must be positive", r.Budget)
+	}
+	if r.Budget == 0 {
+		r.Budget = 3
+	}
+	r.window = time.Hour
+	if r.Window != "" {
+		w, err := time.ParseDuration(r.Window)
+		if err != nil || w <= 0 {
+			return fmt.Errorf("bad window %q", r.Window)
+		}
+		r.window = w
+	}
+	if r.Notify != "" {
+		u, err := url.Parse(r.Notify)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("bad notify URL, must be http or https")
+		}
+	}
+	return nil
+}
+
+// events holds what we've learned from the docker events of a service.
+type events struct {
+	mu         sync.Mutex
+	killed     map[string]bool // containers that are killed (stopped) on purpose, their die is expected
+	dies       []time.Time     // unexpected dies within _CRASHLOOPWINDOW
+	looping    bool
+	remediated []time.Time // remediations within the Remediate window
+	exhausted  bool
+}
+
+// prune returns ts without the times before since.
+func prune(ts []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(ts) && ts[i].Before(since) {
+		i++
+	}
+	return ts[i:]
+}
+
+// watchEvents subscribes to the docker events of the service's compose project and handles them, until ctx is
+// canceled. When the connection to docker is lost it subscribes again.
+func (s *Service) watchEvents(ctx context.Context) {
+	for {
+		ch, err := s.Compose.Events(ctx)
+		if err != nil {
+			log.Debugf("[%s]: Failed to subscribe to docker events: %v", s.Name, err)
+		} else {
+			for e := range ch {
+				s.event(ctx, e)
+			}
+		}
+		select {
+		case <-time.After(_EVENTRETRY):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// event handles a single docker event, remediations are traced as children of the span in ctx, if any.
+func (s *Service) event(ctx context.Context, e compose.Event) {
+	action, _, _ := strings.Cut(e.Action, ":") // health_status: healthy
+	switch action {
+	case "kill":
+		s.ev.mu.Lock()
+		if s.ev.killed == nil {
+			s.ev.killed = map[string]bool{}
+		}
+		s.ev.killed[e.ID] = true
+		s.ev.mu.Unlock()
+		return
+	case "die", "oom", "restart", "health_status":
+	default:
+		return
+	}
+	metric.ContainerEventCount.WithLabelValues(s.Name, action).Inc()
+
+	switch {
+	case action == "die":
+		s.ev.mu.Lock()
+		expected := s.ev.killed[e.ID]
+		delete(s.ev.killed, e.ID)
+		s.ev.mu.Unlock()
+		if expected {
+			return
+		}
+		log.Warningf("[%s]: Container %q died with exit code %s", s.Name, e.Name, e.Attributes["exitCode"])
+		logfile.Logger(s.Name, "event").Warn("container died", "container", e.Name, "exit_code", e.Attributes["exitCode"])
+		s.died()
+		s.remediate(ctx, e, "up")
+
+	case e.Action == "health_status: unhealthy":
+		log.Warningf("[%s]: Container %q is unhealthy", s.Name, e.Name)
+		logfile.Logger(s.Name, "event").Warn("container unhealthy", "container", e.Name)
+		s.remediate(ctx, e, "restart")
+	}
+}
+
+// died records an unexpected die of one of the service's containers, and notifies when the service starts
+// crash looping.
+func (s *Service) died() {
+	s.ev.mu.Lock()
+	s.ev.dies = append(prune(s.ev.dies, time.Now().Add(-_CRASHLOOPWINDOW)), time.Now())
+	start := !s.ev.looping && len(s.ev.dies) >= _CRASHLOOPDIES
+	s.ev.mu.Unlock()
+	if start {
+		s.notify(fmt.Sprintf("Service is crash looping, containers died %d times in the last %s", _CRASHLOOPDIES, _CRASHLOOPWINDOW))
+	}
+	s.CrashLooping()
+}
+
+// CrashLooping returns true if the containers of the service died unexpectedly at least 5 times in the last
+// 10 minutes.
+func (s *Service) CrashLooping() bool {
+	s.ev.mu.Lock()
+	defer s.ev.mu.Unlock()
+	s.ev.dies = prune(s.ev.dies, time.Now().Add(-_CRASHLOOPWINDOW))
+	s.ev.looping = len(s.ev.dies) >= _CRASHLOOPDIES
+	if s.ev.looping {
+		metric.CrashLooping.WithLabelValues(s.Name).Set(1)
+	} else {
+		metric.CrashLooping.WithLabelValues(s.Name).Set(0)
+	}
+	return s.ev.looping
+}
+
+// remediate ups (action is "up") or restarts (action is "restart") the container's compose service, if
+// remediation is configured and there is budget left. Nothing is done while the service is being deployed, the
+// deploy takes care of the containers.
+func (s *Service) remediate(ctx context.Context, e compose.Event, action string) {
+	if s.Remediate == nil || e.Service == "" || s.forcedDown() {
+		return
+	}
+	if !s.dmu.TryLock() {
+		log.Infof("[%s]: Service is being deployed, not remediating %q", s.Name, e.Name)
+		return
+	}
+	defer s.dmu.Unlock()
+	s.ev.mu.Lock()
+	s.ev.remediated = prune(s.ev.remediated, time.Now().Add(-s.Remediate.window))
+	if len(s.ev.remediated) >= s.Remediate.Budget {
+		first := !s.ev.exhausted
+		s.ev.exhausted = true
+		s.ev.mu.Unlock()
+		if first {
+			s.notify(fmt.Sprintf("Remediation budget of %d in %s is exhausted, not remediating %q", s.Remediate.Budget, s.Remediate.window, e.Name))
+		}
+		return
+	}
+	s.ev.exhausted = false
+	s.ev.remediated = append(s.ev.remediated, time.Now())
+	s.ev.mu.Unlock()
+
+	log.Infof("[%s]: Remediating container %q with %s of %q", s.Name, e.Name, action, e.Service)
+	logfile.Logger(s.Name, "remediate").Info("remediating", "container", e.Name, "action", action)
+	metric.RemediationCount.WithLabelValues(s.Name, action).Inc()
+	ctx, span := tracing.Begin(ctx, s.Name, "remediate "+action)
+	var err error
+	switch action {
+	case "up":
+		_, err = s.Compose.Up(ctx, []string{e.Service})
+	case "restart":
+		_, err = s.Compose.RestartContainers(ctx, []string{e.Service})
+	}
+	tracing.Exit(span, err)
+	if err != nil {
+		log.Warningf("[%s]: Failed to remediate %q: %v", s.Name, e.Service, err)
+	}
+}
+
+// notify logs msg and, if configured, posts it as JSON to the notify URL.
+func (s *Service) notify(msg string) {
+	log.Warningf("[%s]: %s", s.Name, msg)
+	logfile.Logger(s.Name, "notify").Warn(msg)
+	if s.Remediate == nil || s.Remediate.Notify == "" {
+		return
+	}
+	buf, _ := json.Marshal(struct {
+		Service string `json:"service"`
+		Host    string `json:"host"`
+		Message string `json:"message"`
+	}{s.Name, osutil.Hostname(), msg})
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Remediate.Notify, bytes.NewReader(buf))
+	if err != nil {
+		log.Warningf("[%s]: Failed to notify: %v", s.Name, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Warningf("[%s]: Failed to notify: %v", s.Name, osutil.Redact(err.Error()))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Warningf("[%s]: Failed to notify: %s", s.Name, resp.Status)
+	}
+}
@@ -0,0 +1,74 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// HAProxyCerts is the directory with the certificates (PEM files with the key) HAProxy uses.
+const HAProxyCerts = "/etc/haproxy/certs"
+
+// haproxy generates a HAProxy frontend with a backend per route. Basic auth and tls "internal" are not
+// supported.
+type haproxy struct{}
+
+func (haproxy) Labels(string, []*Route) (map[string]map[string]string, error) { return nil, nil }
+
+func (haproxy) Import(routes []*Route) ([]byte, error) {
+	if err := unsupported("haproxy", routes, false, false); err != nil {
+		return nil, err
+	}
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "frontend pgo\n\tmode http\n\tbind :443 ssl crt %s\n", HAProxyCerts)
+	hosts(routes, func(routes []*Route) {
+		for _, a := range aliases(routes) {
+			fmt.Fprintf(out, "\thttp-request redirect prefix https://%s code 301 if { hdr(host) -i %s }\n", routes[0].Host, a)
+		}
+	})
+	hosts(routes, func(routes []*Route) {
+		for i, r := range routes {
+			path, all := prefix(r.Path)
+			switch {
+			case r.Path == "":
+				fmt.Fprintf(out, "\tuse_backend %s if { hdr(host) -i %s }\n", haproxyBackend(r, i), r.Host)
+			case all:
+				fmt.Fprintf(out, "\tuse_backend %s if { hdr(host) -i %s } { path_beg %s }\n", haproxyBackend(r, i), r.Host, path)
+			default:
+				fmt.Fprintf(out, "\tuse_backend %s if { hdr(host) -i %s } { path %s }\n", haproxyBackend(r, i), r.Host, path)
+			}
+		}
+	})
+	hosts(routes, func(routes []*Route) {
+		for i, r := range routes {
+			fmt.Fprintf(out, "\nbackend %s\n\tmode http\n", haproxyBackend(r, i))
+			if len(r.Allow) > 0 {
+				fmt.Fprintf(out, "\thttp-request deny if !{ src %s }\n", strings.Join(r.Allow, " "))
+			}
+			for _, k := range sortedKeys(r.Headers) {
+				fmt.Fprintf(out, "\thttp-request %s\n", haproxyHeader(k, r.Headers[k]))
+			}
+			for _, k := range sortedKeys(r.ResponseHeaders) {
+				fmt.Fprintf(out, "\thttp-response %s\n", haproxyHeader(k, r.ResponseHeaders[k]))
+			}
+			for _, e := range r.Encode {
+				if e == "gzip" {
+					fmt.Fprintf(out, "\tcompression algo gzip\n")
+				}
+			}
+			fmt.Fprintf(out, "\tserver %s %s\n", strings.ReplaceAll(r.Target, ":", "_"), r.Target)
+		}
+	})
+	return out.Bytes(), nil
+}
+
+// haproxyBackend returns the name of the backend of route r, the i-th route of its host.
+func haproxyBackend(r *Route, i int) string { return fmt.Sprintf("%s_%d", r.Host, i) }
+
+// haproxyHeader returns the action setting or deleting header k.
+func haproxyHeader(k, v string) string {
+	if strings.HasPrefix(k, "-") {
+		return "del-header " + k[1:]
+	}
+	return fmt.Sprintf("set-header %s \"%s\"", k, v)
+}
@@ -0,0 +1,157 @@
+package conf
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/pgo/compose"
+	"github.com/miekg/pgo/metric"
+	"github.com/miekg/pgo/osutil"
+	"go.science.ru.nl/log"
+)
+
+// Limits are the resource limits for all containers of a service together. They use the syntax of
+// systemd.resource-control(5).
+type Limits struct {
+	CPU      string `toml:"cpu,omitempty"`       // CPUQuota, as a percentage of one CPU, i.e. "150%"
+	Memory   string `toml:"memory,omitempty"`    // MemoryMax, in bytes with an optional K, M, G or T suffix, i.e. "512M"
+	IOWeight int    `toml:"io_weight,omitempty"` // IOWeight, between 1 and 10000, the default is 100
+}
+
+func (l *Limits) parse() error {
+	if l.CPU != "" {
+		if _, err := cpuPercent(l.CPU); err != nil {
+			return err
+		}
+	}
+	if l.Memory != "" {
+		if _, err := memoryBytes(l.Memory); err != nil {
+			return err
+		}
+	}
+	if l.IOWeight != 0 && (l.IOWeight < 1 || l.IOWeight > 10000) {
+		return fmt.Errorf("bad io_weight %d, must be between 1 and 10000", l.IOWeight)
+	}
+	return nil
+}
+
+// properties returns the limits as systemd slice properties.
+func (l *Limits) properties() []string {
+	p := []string{}
+	if l.CPU != "" {
+		p = append(p, "CPUQuota="+l.CPU)
+	}
+	if l.Memory != "" {
+		p = append(p, "MemoryMax="+l.Memory)
+	}
+	if l.IOWeight != 0 {
+		p = append(p, "IOWeight="+strconv.Itoa(l.IOWeight))
+	}
+	return p
+}
+
+// files returns the limits as cgroup v2 controller files and their contents.
+func (l *Limits) files() map[string]string {
+	f := map[string]string{}
+	if pct, err := cpuPercent(l.CPU); err == nil {
+		f["cpu.max"] = fmt.Sprintf("%d 100000", pct*1000)
+	}
+	if b, err := memoryBytes(l.Memory); err == nil {
+		f["memory.max"] = strconv.FormatUint(b, 10)
+	}
+	if l.IOWeight != 0 {
+		f["io.weight"] = "default " + strconv.Itoa(l.IOWeight)
+	}
+	return f
+}
+
+// cpuPercent parses s, i.e. "150%", and returns 150.
+func cpuPercent(s string) (uint64, error) {
+	if !strings.HasSuffix(s, "%") {
+		return 0, fmt.Errorf("bad cpu %q, must be a percentage", s)
+	}
+	pct, err := strconv.ParseUint(strings.TrimSuffix(s, "%"), 10, 32)
+	if err != nil || pct == 0 {
+		return 0, fmt.Errorf("bad cpu %q, must be a positive percentage", s)
+	}
+	return pct, nil
+}
+
+// memoryBytes parses s, i.e. "512M", and returns the number of bytes. Suffixes are base 1024.
+func memoryBytes(s string) (uint64, error) {
+	mult := uint64(1)
+	num := s
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			num = s[:len(s)-1]
+		}
+	}
+	b, err := strconv.ParseUint(num, 10, 64)
+	if err != nil || b == 0 {
+		return 0, fmt.Errorf("bad memory %q, must be a positive number of bytes with an optional K, M, G or T suffix", s)
+	}
+	return b * mult, nil
+}
+
+// cgroupName returns the name of the cgroup of the service.
+func cgroupName(name string) string { return "pgo-" + name }
+
+// sliceName returns the name of the systemd slice of the service. Dashes in name are escaped, as they denote the
+// slice hierarchy: "a-b" would otherwise end up in the slice of "a".
+func sliceName(name string) string {
+	return cgroupName(strings.ReplaceAll(name, "-", `\x2d`)) + ".slice"
+}
+
+// limit puts the service's containers in their own systemd slice, or cgroup when docker doesn't use the systemd
+// cgroup driver, with the configured limits. This is done when the limits differ from the ones applied last, on
+// failure it's retried the next time.
+func (s *Service) limit() {
+	if s.Limits == nil || s.limited == strings.Join(s.Limits.properties(), " ") {
+		return
+	}
+	driver, err := compose.NewEngine("").CgroupDriver()
+	if err != nil {
+		log.Warningf("[%s]: Failed to get cgroup driver of docker, not limiting resources: %v", s.Name, err)
+		return
+	}
+	name := cgroupName(s.Name)
+	parent, dir := "/"+name, filepath.Join(osutil.CgroupRoot, name)
+	if driver == "systemd" {
+		parent = sliceName(s.Name)
+		dir = osutil.SlicePath(parent)
+		err = osutil.Slice(parent, s.Limits.properties())
+	} else {
+		err = osutil.Cgroup(name, s.Limits.files())
+	}
+	if err != nil {
+		log.Warningf("[%s]: Failed to set up %q, not limiting resources: %v", s.Name, parent, err)
+		return
+	}
+	log.Infof("[%s]: Running containers in %q with limits %v", s.Name, parent, s.Limits.properties())
+	s.Compose.SetCgroupParent(parent)
+	metric.RegisterCgroup(s.Name, dir)
+	s.limited = strings.Join(s.Limits.properties(), " ")
+}
+
+// removeLimits removes the systemd slice or cgroup of the (stale) service name.
+func removeLimits(name string) {
+	if err := osutil.RemoveSlice(sliceName(name)); err != nil {
+		log.Warningf("[%s]: Failed to remove slice: %v", name, err)
+	}
+	if err := osutil.RemoveCgroup(cgroupName(name)); err != nil {
+		log.Warningf("[%s]: Failed to remove cgroup: %v", name, err)
+	}
+	metric.UnregisterCgroup(name)
+}
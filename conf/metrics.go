@@ -0,0 +1,81 @@
+package conf
+
+import (
+	"time"
+
+	"github.com/miekg/pgo/compose"
+	"github.com/miekg/pgo/logfile"
+	"github.com/miekg/pgo/metric"
+	"go.science.ru.nl/log"
+)
+
+// violated counts err in the policy violation metric if it's a violation of one of the compose rules, and
+// returns err.
+func (s *Service) violated(err error) error {
+	if rule := compose.Rule(err); rule != "" {
+		metric.PolicyViolationCount.WithLabelValues(s.Name, rule).Inc()
+		logfile.Logger(s.Name, "policy").Warn("policy violation", "rule", rule, "error", err.Error())
+	}
+	return err
+}
+
+// deployed records the duration of the deploy that started at start, and the time of it if err is nil. The
+// deploy is logged to the service's log file.
+func (s *Service) deployed(start time.Time, err error) {
+	metric.DeployDuration.WithLabelValues(s.Name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		logfile.Logger(s.Name, "deploy").Error("deploy failed", "duration", time.Since(start), "error", err.Error())
+		return
+	}
+	logfile.Logger(s.Name, "deploy").Info("deployed", "duration", time.Since(start))
+	metric.DeployTimestamp.WithLabelValues(s.Name).SetToCurrentTime()
+	s.st.mu.Lock()
+	s.st.deployed = time.Now()
+	s.st.mu.Unlock()
+}
+
+// pulled records a successful git pull and the hash we are on now.
+func (s *Service) pulled() {
+	hash := s.Git.Hash()
+	metric.PullTimestamp.WithLabelValues(s.Name).SetToCurrentTime()
+	metric.SetGitHash(s.Name, hash)
+	logfile.SetHash(s.Name, hash)
+	logfile.Logger(s.Name, "pull").Info("pulled")
+}
+
+// containerStates updates the number of containers per state of the service.
+func (s *Service) containerStates() {
+	cs, err := s.Compose.Containers()
+	if err != nil {
+		log.Debugf("[%s]: Failed to get containers: %v", s.Name, err)
+		return
+	}
+	count := map[string]int{}
+	for _, c := range cs {
+		count[c.State]++
+	}
+	metric.SetContainers(s.Name, count)
+}
+
+// containerStats returns the resource usage of the service's containers, for the container collector.
+func (s *Service) containerStats() ([]metric.ContainerStats, error) {
+	cs, err := s.Compose.Stats()
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]metric.ContainerStats, len(cs))
+	for i, c := range cs {
+		stats[i] = metric.ContainerStats{
+			Name:         c.Name,
+			CPUSeconds:   c.CPUSeconds,
+			MemoryBytes:  float64(c.MemoryBytes),
+			NetRxBytes:   float64(c.NetRxBytes),
+			NetTxBytes:   float64(c.NetTxBytes),
+			BlockRead:    float64(c.BlockReadBytes),
+			BlockWrite:   float64(c.BlockWriteBytes),
+			RestartCount: c.RestartCount,
+			Health:       c.Health,
+		}
+	}
+	return stats, nil
+}
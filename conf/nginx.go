@@ -0,0 +1,80 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// NginxCerts is the directory where nginx finds the certificate (<host>.crt) and key (<host>.key) of each host.
+const NginxCerts = "/etc/nginx/certs"
+
+// nginx generates nginx server blocks, to be included in the http context. Basic auth and tls "internal" are
+// not supported.
+type nginx struct{}
+
+func (nginx) Labels(string, []*Route) (map[string]map[string]string, error) { return nil, nil }
+
+func (nginx) Import(routes []*Route) ([]byte, error) {
+	if err := unsupported("nginx", routes, false, false); err != nil {
+		return nil, err
+	}
+	out := &bytes.Buffer{}
+	hosts(routes, func(routes []*Route) {
+		host := routes[0].Host
+		nginxServer(out, host)
+		for _, r := range routes {
+			nginxLocation(out, r)
+		}
+		fmt.Fprintf(out, "}\n")
+
+		for _, a := range aliases(routes) {
+			nginxServer(out, a)
+			fmt.Fprintf(out, "\treturn 301 https://%s$request_uri;\n}\n", host)
+		}
+	})
+	return out.Bytes(), nil
+}
+
+// nginxServer writes the start of the server block for host.
+func nginxServer(out *bytes.Buffer, host string) {
+	fmt.Fprintf(out, "server {\n\tlisten 443 ssl;\n\tlisten [::]:443 ssl;\n\tserver_name %s;\n", host)
+	fmt.Fprintf(out, "\tssl_certificate %s/%s.crt;\n\tssl_certificate_key %s/%s.key;\n", NginxCerts, host, NginxCerts, host)
+}
+
+// nginxLocation writes the location block for route r.
+func nginxLocation(out *bytes.Buffer, r *Route) {
+	path, all := prefix(r.Path)
+	if all {
+		fmt.Fprintf(out, "\tlocation %s {\n", path)
+	} else {
+		fmt.Fprintf(out, "\tlocation = %s {\n", path)
+	}
+	for _, a := range r.Allow {
+		fmt.Fprintf(out, "\t\tallow %s;\n", a)
+	}
+	if len(r.Allow) > 0 {
+		fmt.Fprintf(out, "\t\tdeny all;\n")
+	}
+	for _, e := range r.Encode {
+		if e == "gzip" { // zstd needs a third party module
+			fmt.Fprintf(out, "\t\tgzip on;\n")
+		}
+	}
+	for _, k := range sortedKeys(r.ResponseHeaders) {
+		if strings.HasPrefix(k, "-") {
+			fmt.Fprintf(out, "\t\tproxy_hide_header %s;\n", k[1:])
+			continue
+		}
+		fmt.Fprintf(out, "\t\tadd_header %s \"%s\" always;\n", k, r.ResponseHeaders[k])
+	}
+	fmt.Fprintf(out, "\t\tproxy_set_header Host $host;\n")
+	for _, k := range sortedKeys(r.Headers) {
+		if strings.HasPrefix(k, "-") {
+			fmt.Fprintf(out, "\t\tproxy_set_header %s \"\";\n", k[1:])
+			continue
+		}
+		fmt.Fprintf(out, "\t\tproxy_set_header %s \"%s\";\n", k, r.Headers[k])
+	}
+	fmt.Fprintf(out, "\t\tproxy_pass http://%s;\n\t}\n", r.Target)
+}
@@ -0,0 +1,69 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+)
+
+// Check validates c beyond what Parse does, for pgod --check: the users of the services must exist (unless
+// they are created, see CreateUsers) and the deploy keys and known hosts files must exist. It returns all
+// problems found. Check doesn't need root.
+func (c *Config) Check() []error {
+	errs := []error{}
+	for _, s := range c.Services {
+		if _, err := user.Lookup(s.User); err != nil && !c.CreateUsers {
+			errs = append(errs, fmt.Errorf("user %q of service %q does not exist", s.User, s.Name))
+		}
+		for _, f := range []string{s.DeployKey, s.KnownHosts} {
+			if f == "" {
+				continue
+			}
+			if _, err := os.Stat(f); err != nil {
+				errs = append(errs, fmt.Errorf("service %q: %s", s.Name, err))
+			}
+		}
+	}
+	return errs
+}
+
+// Plan is what pgod does when it starts with a config, given the state of its directory, see Config.Plan.
+type Plan struct {
+	Clone   []string // services without a checkout, they are cloned
+	Restart []string // services with a checkout, they are pulled and upped again
+	Down    []string // services that are forced down with a stop file, a subset of Clone and Restart
+	Stale   []string // checkouts of services not in the config, they are downed and removed
+	Users   []string // users that are created, see CreateUsers
+}
+
+// Plan compares c against the checkouts in dir and returns what pgod would do with it. It doesn't need root
+// and doesn't touch docker.
+func (c *Config) Plan(dir string) (*Plan, error) {
+	p := &Plan{}
+	users := map[string]bool{}
+	for _, s := range c.Services {
+		fulldir := path.Join(dir, s.Name)
+		if _, err := os.Stat(fulldir); err != nil {
+			p.Clone = append(p.Clone, s.Name)
+		} else {
+			p.Restart = append(p.Restart, s.Name)
+		}
+		if _, err := os.Stat(fulldir + _STOPFILE); err == nil {
+			p.Down = append(p.Down, s.Name)
+		}
+		if _, err := user.Lookup(s.User); err != nil && c.CreateUsers && !users[s.User] {
+			p.Users = append(p.Users, s.User)
+			users[s.User] = true
+		}
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return p, nil
+	}
+	stale, err := staleNames(c.Services, dir)
+	if err != nil {
+		return nil, err
+	}
+	p.Stale = stale
+	return p, nil
+}
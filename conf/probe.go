@@ -0,0 +1,232 @@
+package conf
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/pgo/logfile"
+	"github.com/miekg/pgo/metric"
+	"go.science.ru.nl/log"
+)
+
+// _PROBERETRY is the time to wait before probing again after a deploy, see Probe.Deploy.
+const _PROBERETRY = 5 * time.Second
+
+// Probe configures the periodic probing of the URLs of a service's routes.
+type Probe struct {
+	Interval string `toml:"interval,omitempty"` // i.e. "1m", the default
+	Timeout  string `toml:"timeout,omitempty"`  // of a single probe, "10s" by default
+	Internal bool   `toml:"internal,omitempty"` // also probe the targets of the routes, on the container's network
+	Deploy   string `toml:"deploy,omitempty"`   // after a deploy probe until all succeed for at most this long, failing the deploy if they don't
+
+	interval time.Duration
+	timeout  time.Duration
+	deploy   time.Duration
+}
+
+func (p *Probe) parse() error {
+	for _, d := range []struct {
+		name string
+		s    string
+		d    *time.Duration
+		def  time.Duration
+	}{
+		{"interval", p.Interval, &p.interval, time.Minute},
+		{"timeout", p.Timeout, &p.timeout, 10 * time.Second},
+		{"deploy", p.Deploy, &p.deploy, 0},
+	} {
+		*d.d = d.def
+		if d.s == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.s)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("bad %s %q", d.name, d.s)
+		}
+		*d.d = v
+	}
+	return nil
+}
+
+// probeURL is a URL that is probed. For internal probes the connection goes to the container's address.
+type probeURL struct {
+	url      string
+	host     string // Host header, for internal probes
+	service  string // compose service of the container, for internal probes
+	insecure bool   // don't verify the certificate, for tls "internal"
+}
+
+// probeURLs returns the URLs to probe for the routes of s.
+func (s *Service) probeURLs() []probeURL {
+	urls := []probeURL{}
+	for _, r := range s.Routes {
+		path := r.Path
+		if p, all := prefix(r.Path); all {
+			path = p
+		}
+		urls = append(urls, probeURL{url: "https://" + r.Host + path, insecure: r.TLS != ""})
+		if s.Probe.Internal {
+			service, _, _ := net.SplitHostPort(r.Target)
+			urls = append(urls, probeURL{url: "http://" + r.Target + path, host: r.Host, service: service})
+		}
+	}
+	return urls
+}
+
+// probes probes the URLs of s every Probe interval, until ctx is canceled.
+func (s *Service) probes(ctx context.Context) {
+	if s.Probe == nil || len(s.Routes) == 0 {
+		return
+	}
+	for {
+		select {
+		case <-time.After(jitter(s.Probe.interval)):
+		case <-ctx.Done():
+			return
+		}
+		if s.forcedDown() {
+			continue
+		}
+		s.probeAll(ctx)
+	}
+}
+
+// probeAll probes all URLs of s once and records the results as metrics. It returns the URLs that failed.
+func (s *Service) probeAll(ctx context.Context) []string {
+	failed := []string{}
+	for _, u := range s.probeURLs() {
+		addr := ""
+		if u.service != "" {
+			var err error
+			if addr, err = s.containerAddr(u.service); err != nil {
+				log.Warningf("[%s]: Failed to probe %s: %v", s.Name, u.url, err)
+				metric.ProbeSuccess.WithLabelValues(s.Name, u.url).Set(0)
+				metric.ProbeStatus.WithLabelValues(s.Name, u.url).Set(0)
+				failed = append(failed, u.url)
+				continue
+			}
+		}
+
+		start := time.Now()
+		status, expiry, err := probe(ctx, u, addr, s.Probe.timeout)
+		duration := time.Since(start)
+
+		metric.ProbeDuration.WithLabelValues(s.Name, u.url).Set(duration.Seconds())
+		metric.ProbeStatus.WithLabelValues(s.Name, u.url).Set(float64(status))
+		if !expiry.IsZero() {
+			metric.ProbeCertExpiry.WithLabelValues(s.Name, u.url).Set(float64(expiry.Unix()))
+		}
+		if err == nil && status >= 500 {
+			err = fmt.Errorf("status %d", status)
+		}
+		if err != nil {
+			log.Warningf("[%s]: Failed to probe %s: %v", s.Name, u.url, err)
+			logfile.Logger(s.Name, "probe").Warn("probe failed", "url", u.url, "duration", duration, "error", err.Error())
+			metric.ProbeSuccess.WithLabelValues(s.Name, u.url).Set(0)
+			failed = append(failed, u.url)
+			continue
+		}
+		metric.ProbeSuccess.WithLabelValues(s.Name, u.url).Set(1)
+	}
+	return failed
+}
+
+// probeDeploy probes the URLs of s after a deploy, until they all succeed, for at most the Probe's deploy
+// duration. An error is returned when they don't, or when ctx is canceled first.
+func (s *Service) probeDeploy(ctx context.Context) error {
+	if s.Probe == nil || s.Probe.deploy == 0 || len(s.Routes) == 0 {
+		return nil
+	}
+	end := time.Now().Add(s.Probe.deploy)
+	for {
+		failed := s.probeAll(ctx)
+		if len(failed) == 0 {
+			return nil
+		}
+		if time.Now().Add(_PROBERETRY).After(end) {
+			return fmt.Errorf("probes failed after deploy: %s", strings.Join(failed, ", "))
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("probes after deploy stopped: %s", ctx.Err())
+		case <-time.After(_PROBERETRY):
+		}
+	}
+}
+
+// containerAddr returns the IP address of a running container of the compose service on the external network
+// it shares with the reverse proxy.
+func (s *Service) containerAddr(service string) (string, error) {
+	nets, err := s.Compose.ExternalNetworks(service)
+	if err != nil {
+		return "", err
+	}
+	if len(nets) == 0 {
+		return "", fmt.Errorf("%q is not attached to an external network", service)
+	}
+	cs, err := s.Compose.Containers()
+	if err != nil {
+		return "", err
+	}
+	for _, c := range cs {
+		if c.Service != service || c.State != "running" {
+			continue
+		}
+		ci, err := s.Compose.Inspect(c.ID)
+		if err != nil {
+			return "", err
+		}
+		for _, n := range nets {
+			if ip := ci.Networks[n]; ip != "" {
+				return ip, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no running container with an address on %s for %q", strings.Join(nets, ", "), service)
+}
+
+// probe does a GET of u, connecting to addr (the IP address of a container) if not empty. It returns the
+// status code and the expiry of the TLS certificate, if any. Redirects are not followed.
+func probe(ctx context.Context, u probeURL, addr string, timeout time.Duration) (int, time.Time, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	tr := &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: u.insecure},
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if addr != "" {
+				_, port, _ := net.SplitHostPort(address)
+				address = net.JoinHostPort(addr, port)
+			}
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+	defer tr.CloseIdleConnections()
+	client := &http.Client{
+		Transport:     tr,
+		Timeout:       timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if u.host != "" {
+		req.Host = u.host
+	}
+	req.Header.Set("User-Agent", "pgod probe")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp.Body.Close()
+	expiry := time.Time{}
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		expiry = resp.TLS.PeerCertificates[0].NotAfter
+	}
+	return resp.StatusCode, expiry, nil
+}
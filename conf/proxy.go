@@ -0,0 +1,157 @@
+package conf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"go.science.ru.nl/log"
+)
+
+// Generator generates the config of a reverse proxy from the routes of all services.
+type Generator interface {
+	// Import returns the contents of the import file, for all routes.
+	Import(routes []*Route) ([]byte, error)
+	// Labels returns the labels to add to the compose services of the service name, for its routes. The labels
+	// are keyed by compose service.
+	Labels(name string, routes []*Route) (map[string]map[string]string, error)
+}
+
+// Proxies are the supported reverse proxies, selected with proxy in the config.
+var Proxies = map[string]Generator{
+	"caddy":   caddy{},
+	"nginx":   nginx{},
+	"haproxy": haproxy{},
+	"traefik": traefik{},
+}
+
+// Routes returns the routes of all services, sorted, see sortRoutes.
+func (c *Config) Routes() []*Route {
+	routes := []*Route{}
+	for _, s := range c.Services {
+		routes = append(routes, s.Routes...)
+	}
+	sortRoutes(routes)
+	return routes
+}
+
+// hosts calls f for each host in routes, with the routes for that host. Routes must be sorted.
+func hosts(routes []*Route, f func(routes []*Route)) {
+	for i := 0; i < len(routes); {
+		j := i + 1
+		for j < len(routes) && routes[j].Host == routes[i].Host {
+			j++
+		}
+		f(routes[i:j])
+		i = j
+	}
+}
+
+// aliases returns the sorted and unique aliases of routes.
+func aliases(routes []*Route) []string {
+	as := []string{}
+	seen := map[string]bool{}
+	for _, r := range routes {
+		for _, a := range r.Aliases {
+			if !seen[a] {
+				as = append(as, a)
+				seen[a] = true
+			}
+		}
+	}
+	sort.Strings(as)
+	return as
+}
+
+// hostTLS returns the tls setting of the host of routes.
+func hostTLS(routes []*Route) string {
+	for _, r := range routes {
+		if r.TLS != "" {
+			return r.TLS
+		}
+	}
+	return ""
+}
+
+// unsupported returns an error if one of the routes uses a feature that proxy doesn't support.
+func unsupported(proxy string, routes []*Route, basicAuth, tls bool) error {
+	for _, r := range routes {
+		if !basicAuth && len(r.BasicAuth) > 0 {
+			return fmt.Errorf("basic_auth for %s is not supported with %s", r.Host, proxy)
+		}
+		if !tls && r.TLS != "" {
+			return fmt.Errorf("tls for %s is not supported with %s", r.Host, proxy)
+		}
+	}
+	return nil
+}
+
+// prefix returns the path of a route without the trailing "*" and true if the route matches all paths below
+// it, i.e. "/api/*" returns "/api/", true. An empty path returns "/", true.
+func prefix(path string) (string, bool) {
+	if path == "" {
+		return "/", true
+	}
+	if strings.HasSuffix(path, "*") {
+		return strings.TrimSuffix(path, "*"), true
+	}
+	return path, false
+}
+
+// setProxied sets the routes the import file is generated from.
+func (s *Service) setProxied(routes []*Route) {
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	s.proxied = routes
+}
+
+// updateImport generates the import data, if it changed (or force is true) the import file is written and the
+// proxy reloaded. Otherwise, with an admin API, the config is pushed again, which is a noop if Caddy already
+// runs it, but a restarted Caddy gets it back.
+func (s *Service) updateImport(ctx context.Context, force bool) {
+	s.pmu.Lock()
+	defer s.pmu.Unlock()
+	if s.makeImport() || force {
+		s.writeImport(ctx)
+		return
+	}
+	if s.Admin != "" {
+		s.loadProxy()
+	}
+}
+
+// makeImport generates the import data from the valid routes, see checkRoutes. It returns true if the data
+// changed.
+func (s *Service) makeImport() bool {
+	data, err := Proxies[s.Proxy].Import(valid(s.proxied))
+	if err != nil { // can't happen, all routes are checked in Parse
+		log.Warningf("[%s]: Failed to generate import file: %v", s.Name, err)
+		return false
+	}
+	if bytes.Equal(data, s.importdata) {
+		return false
+	}
+	s.importdata = data
+	return true
+}
+
+// writeImport writes the import file and reloads the reverse proxy, or pushes it to Caddy's admin API. Ctx
+// carries the span the reload command is traced under.
+func (s *Service) writeImport(ctx context.Context) {
+	name := path.Join(s.dir, s.Import)
+	log.Infof("[%s]: Writing %s import file %q", s.Name, s.Proxy, s.Import)
+	os.WriteFile(name, s.importdata, 0644) // with 644 we shouldn't care about ownership
+
+	if s.Admin != "" {
+		s.loadProxy()
+		return
+	}
+	log.Infof("[%s]: Reloading %s", s.Name, s.Proxy)
+	if _, err := s.Compose.Exec(ctx, s.reloadcmd); err != nil {
+		log.Warningf("[%s]: Failed exec reload command: %v", s.Name, err)
+	}
+}
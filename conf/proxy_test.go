@@ -0,0 +1,283 @@
+package conf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const proxyConf = `
+[[services]]
+name = "web"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/web"
+urls = { "b.example.org" = "web:80" }
+
+[[services.routes]]
+host = "a.example.org"
+target = "web:80"
+aliases = [ "www.a.example.org" ]
+encode = [ "gzip" ]
+
+[[services.routes]]
+host = "a.example.org"
+path = "/api/*"
+target = "api:8080"
+headers = { "X-Real-Host" = "a.example.org", "-Cookie" = "" }
+response_headers = { "Cache-Control" = "no-store" }
+allow = [ "10.0.0.0/8" ]
+`
+
+func TestNginxImport(t *testing.T) {
+	c, err := Parse([]byte(proxyConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := nginx{}.Import(c.Routes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expect = `server {
+	listen 443 ssl;
+	listen [::]:443 ssl;
+	server_name a.example.org;
+	ssl_certificate /etc/nginx/certs/a.example.org.crt;
+	ssl_certificate_key /etc/nginx/certs/a.example.org.key;
+	location /api/ {
+		allow 10.0.0.0/8;
+		deny all;
+		add_header Cache-Control "no-store" always;
+		proxy_set_header Host $host;
+		proxy_set_header Cookie "";
+		proxy_set_header X-Real-Host "a.example.org";
+		proxy_pass http://api:8080;
+	}
+	location / {
+		gzip on;
+		proxy_set_header Host $host;
+		proxy_pass http://web:80;
+	}
+}
+server {
+	listen 443 ssl;
+	listen [::]:443 ssl;
+	server_name www.a.example.org;
+	ssl_certificate /etc/nginx/certs/www.a.example.org.crt;
+	ssl_certificate_key /etc/nginx/certs/www.a.example.org.key;
+	return 301 https://a.example.org$request_uri;
+}
+server {
+	listen 443 ssl;
+	listen [::]:443 ssl;
+	server_name b.example.org;
+	ssl_certificate /etc/nginx/certs/b.example.org.crt;
+	ssl_certificate_key /etc/nginx/certs/b.example.org.key;
+	location / {
+		proxy_set_header Host $host;
+		proxy_pass http://web:80;
+	}
+}
+`
+	if expect != string(out) {
+		t.Errorf("generated output doesn't match expected\nexpect = %s\ngot = %s\n", expect, out)
+	}
+}
+
+func TestHAProxyImport(t *testing.T) {
+	c, err := Parse([]byte(proxyConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := haproxy{}.Import(c.Routes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expect = `frontend pgo
+	mode http
+	bind :443 ssl crt /etc/haproxy/certs
+	http-request redirect prefix https://a.example.org code 301 if { hdr(host) -i www.a.example.org }
+	use_backend a.example.org_0 if { hdr(host) -i a.example.org } { path_beg /api/ }
+	use_backend a.example.org_1 if { hdr(host) -i a.example.org }
+	use_backend b.example.org_0 if { hdr(host) -i b.example.org }
+
+backend a.example.org_0
+	mode http
+	http-request deny if !{ src 10.0.0.0/8 }
+	http-request del-header Cookie
+	http-request set-header X-Real-Host "a.example.org"
+	http-response set-header Cache-Control "no-store"
+	server api_8080 api:8080
+
+backend a.example.org_1
+	mode http
+	compression algo gzip
+	server web_80 web:80
+
+backend b.example.org_0
+	mode http
+	server web_80 web:80
+`
+	if expect != string(out) {
+		t.Errorf("generated output doesn't match expected\nexpect = %s\ngot = %s\n", expect, out)
+	}
+}
+
+func TestTraefikLabels(t *testing.T) {
+	c, err := Parse([]byte(proxyConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels, err := traefik{}.Labels("web", c.Services[0].Routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]map[string]string{
+		"api": {
+			"traefik.enable":                                                                         "true",
+			"traefik.http.routers.pgo-web-0.rule":                                                    "Host(`a.example.org`) && PathPrefix(`/api/`)",
+			"traefik.http.routers.pgo-web-0.service":                                                 "pgo-web-0",
+			"traefik.http.routers.pgo-web-0.middlewares":                                             "pgo-web-0-allow,pgo-web-0-headers",
+			"traefik.http.services.pgo-web-0.loadbalancer.server.port":                               "8080",
+			"traefik.http.middlewares.pgo-web-0-allow.ipallowlist.sourcerange":                       "10.0.0.0/8",
+			"traefik.http.middlewares.pgo-web-0-headers.headers.customrequestheaders.Cookie":         "",
+			"traefik.http.middlewares.pgo-web-0-headers.headers.customrequestheaders.X-Real-Host":    "a.example.org",
+			"traefik.http.middlewares.pgo-web-0-headers.headers.customresponseheaders.Cache-Control": "no-store",
+		},
+		"web": {
+			"traefik.enable":                                                        "true",
+			"traefik.http.routers.pgo-web-1.rule":                                   "Host(`a.example.org`) || Host(`www.a.example.org`)",
+			"traefik.http.routers.pgo-web-1.service":                                "pgo-web-1",
+			"traefik.http.routers.pgo-web-1.middlewares":                            "pgo-web-1-redirect,pgo-web-1-compress",
+			"traefik.http.services.pgo-web-1.loadbalancer.server.port":              "80",
+			"traefik.http.middlewares.pgo-web-1-redirect.redirectregex.regex":       `^https?://(www\.a\.example\.org)/(.*)`,
+			"traefik.http.middlewares.pgo-web-1-redirect.redirectregex.replacement": "https://a.example.org/${2}",
+			"traefik.http.middlewares.pgo-web-1-redirect.redirectregex.permanent":   "true",
+			"traefik.http.middlewares.pgo-web-1-compress.compress.encodings":        "gzip",
+			"traefik.http.routers.pgo-web-2.rule":                                   "Host(`b.example.org`)",
+			"traefik.http.routers.pgo-web-2.service":                                "pgo-web-2",
+			"traefik.http.services.pgo-web-2.loadbalancer.server.port":              "80",
+		},
+	}
+	if !reflect.DeepEqual(labels, expect) {
+		t.Errorf("labels don't match expected\nexpect = %v\ngot = %v\n", expect, labels)
+	}
+	c.Services[0].Routes[0].invalid.Store(true)
+	labels, err = traefik{}.Labels("web", c.Services[0].Routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := labels["api"]; ok {
+		t.Errorf("expected no labels for the invalid route, got %v", labels["api"])
+	}
+	if !reflect.DeepEqual(labels["web"], expect["web"]) {
+		t.Errorf("expected the labels of the valid routes to be kept, got %v", labels["web"])
+	}
+}
+
+func TestProxyParse(t *testing.T) {
+	const traefikConf = proxyConf + `
+[[services]]
+name = "traefik"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/traefik"
+proxy = "traefik"
+`
+	c, err := Parse([]byte(traefikConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Services[0].labels["web"]["traefik.enable"] != "true" {
+		t.Errorf("expected traefik labels for the web compose service, got %v", c.Services[0].labels)
+	}
+	if c.Services[1].importdata != nil {
+		t.Errorf("expected no import for traefik, got %s", c.Services[1].importdata)
+	}
+
+	const proxy = `
+[[services]]
+name = "proxy"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/proxy"
+`
+	for _, bad := range []string{
+		`proxy = "apache"
+import = "import"`,
+		`proxy = "nginx"`,
+		`proxy = "traefik"
+import = "import"`,
+		`proxy = "nginx"
+import = "import"
+admin = "http://localhost:2019"`,
+		`import = "import"
+admin = "unix://run/caddy/admin.sock"`,
+		`import = "import"
+admin = "localhost:2019"`,
+	} {
+		if _, err := Parse([]byte(proxyConf + proxy + bad)); err == nil {
+			t.Errorf("expected error for %q, got none", bad)
+		}
+	}
+
+	// basic_auth is not supported by nginx
+	const auth = `
+[[services]]
+name = "auth"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/auth"
+[[services.routes]]
+host = "c.example.org"
+target = "auth:80"
+basic_auth = { "miek" = "$2a$14$Zkx19XLiW6VYouLHR5NmfOFU0z2GTNmpkT/5qqR7hx4IjWJPDhjvG" }
+`
+	_, err = Parse([]byte(proxyConf + proxy + "proxy = \"nginx\"\nimport = \"import\"\n" + auth))
+	if err == nil || !strings.Contains(err.Error(), "basic_auth") {
+		t.Errorf("expected basic_auth error, got %v", err)
+	}
+}
+
+func TestUniqueHosts(t *testing.T) {
+	const other = `
+[[services]]
+name = "other"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/other"
+urls = { "www.a.example.org" = "other:80" }
+`
+	if _, err := Parse([]byte(proxyConf + other)); err == nil {
+		t.Fatal("expected error for host used by two services, got none")
+	}
+}
+
+func TestInvalidRoutes(t *testing.T) {
+	const proxy = `
+[[services]]
+name = "proxy"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/proxy"
+import = "import"
+proxy = "nginx"
+reload = "localhost:nginx//exec nginx -s reload"
+`
+	c, err := Parse([]byte(proxyConf + proxy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := c.Services[1]
+	if s.makeImport() {
+		t.Errorf("expected import to be unchanged")
+	}
+	for _, r := range c.Services[0].Routes {
+		if r.Target == "api:8080" {
+			r.invalid.Store(true)
+		}
+	}
+	if !s.makeImport() {
+		t.Fatalf("expected import to change")
+	}
+	if strings.Contains(string(s.importdata), "api:8080") {
+		t.Errorf("expected invalid route to be left out, got %s", s.importdata)
+	}
+	if !strings.Contains(string(s.importdata), "web:80") {
+		t.Errorf("expected valid routes in import, got %s", s.importdata)
+	}
+}
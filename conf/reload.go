@@ -0,0 +1,187 @@
+package conf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/miekg/pgo/logfile"
+	"github.com/miekg/pgo/metric"
+	"github.com/miekg/pgo/osutil"
+	"github.com/miekg/pgo/tracing"
+	toml "github.com/pelletier/go-toml/v2"
+	"go.science.ru.nl/log"
+)
+
+// Tracker runs the trackers (see Service.Track) of the services of a config. Reload switches it to a new config,
+// only the services that are added, removed or modified are started, stopped or restarted.
+type Tracker struct {
+	dir      string
+	datadir  string
+	duration time.Duration
+
+	mu      sync.RWMutex // protects c
+	c       *Config
+	reload  sync.Mutex          // serializes Reload, protects running
+	running map[string]*tracker // running trackers by service name
+	wg      sync.WaitGroup
+
+	init  func(ctx context.Context, s *Service) error // initializes a service, InitGitAndCompose by default
+	track func(ctx context.Context, s *Service)       // tracks a service, Service.Track by default
+	stale func(c *Config) error                       // cleans up removed services, Stale by default
+}
+
+type tracker struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewTracker returns a pointer to an initialized Tracker, dir and datadir are given to InitGitAndCompose and
+// duration to Track.
+func NewTracker(dir, datadir string, duration time.Duration) *Tracker {
+	t := &Tracker{dir: dir, datadir: datadir, duration: duration, running: map[string]*tracker{}}
+	t.init = func(ctx context.Context, s *Service) error { return s.InitGitAndCompose(ctx, t.dir, t.datadir) }
+	t.track = func(ctx context.Context, s *Service) { s.Track(ctx, t.duration) }
+	t.stale = func(c *Config) error { return Stale(c.Services, t.dir, c.Engine, c.DNS) }
+	return t
+}
+
+// Config returns the current config, nil before the first Reload.
+func (t *Tracker) Config() *Config {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.c
+}
+
+// Wait waits until all trackers have returned, after the context given to Reload is canceled.
+func (t *Tracker) Wait() { t.wg.Wait() }
+
+// Reload switches t to config c. Services that are not changed keep running, with their state, as is. Services
+// that are removed are stopped and cleaned up (see Stale), modified services are stopped and started again
+// with their new config, and new services are started. The import files of the reverse proxies are
+// regenerated. The first Reload starts all services. An error is returned when a service can't be initialized,
+// that service is not tracked.
+func (t *Tracker) Reload(ctx context.Context, c *Config) error {
+	t.reload.Lock()
+	defer t.reload.Unlock()
+
+	old := map[string]*Service{}
+	if prev := t.Config(); prev != nil {
+		for _, s := range prev.Services {
+			old[s.Name] = s
+		}
+	}
+	if c.CreateUsers {
+		if err := CreateUsers(c.Services, t.dir); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	start, kept := []*Service{}, []*Service{}
+	sx := make([]*Service, 0, len(c.Services))
+	for _, s := range c.Services {
+		o, ok := old[s.Name]
+		delete(old, s.Name)
+		if ok && o.equal(s) {
+			sx = append(sx, o) // keeps running
+			kept = append(kept, o)
+			continue
+		}
+		if ok {
+			log.Infof("[%s]: Service changed, restarting its tracker", s.Name)
+			t.stop(s.Name)
+			metric.DeleteProbes(s.Name) // its URLs may have changed, the new tracker probes them again
+		}
+		ictx, span := tracing.Begin(ctx, s.Name, "init")
+		err1 := t.init(ictx, s)
+		tracing.Exit(span, err1)
+		if err1 != nil {
+			log.Errorf("[%s]: Failed to initialize service: %v", s.Name, err1)
+			if err == nil {
+				err = fmt.Errorf("service %q: %s", s.Name, err1)
+			}
+			continue
+		}
+		sx = append(sx, s)
+		start = append(start, s)
+	}
+	for name := range old {
+		log.Infof("[%s]: Service removed, stopping its tracker", name)
+		t.stop(name)
+		logfile.Unregister(name)
+		metric.UnregisterContainers(name)
+		metric.DeleteProbes(name)
+	}
+	c.Services = sx
+
+	// A service that failed to initialize isn't in c, so Stale would remove it; leave that for the next Reload.
+	if err == nil {
+		if err := t.stale(c); err != nil {
+			log.Warningf("Failed to clean up stale services: %v", err)
+		}
+	}
+	if c.DNS != nil {
+		if err := c.DNS.Update(c.Services, t.dir); err != nil {
+			log.Warningf("Failed to update DNS records: %v", err)
+		}
+	}
+
+	routes := c.Routes() // with the routes of the kept services, they know which routes are invalid
+	for _, s := range c.Services {
+		if s.Proxy != "" {
+			s.setProxied(routes)
+		}
+	}
+
+	t.mu.Lock()
+	t.c = c
+	t.mu.Unlock()
+
+	for _, s := range kept {
+		if s.Import != "" {
+			s.updateImport(ctx, false)
+		}
+	}
+	for _, s := range start {
+		log.Infof("[%s]: Service %q with upstream %q", s.Name, s.Name, osutil.Redact(s.Repository))
+		sctx, cancel := context.WithCancel(ctx)
+		tr := &tracker{cancel: cancel, done: make(chan struct{})}
+		t.running[s.Name] = tr
+		t.wg.Add(1)
+		go func(s *Service) {
+			defer t.wg.Done()
+			defer close(tr.done)
+			t.track(sctx, s)
+		}(s)
+	}
+	return err
+}
+
+// stop stops the tracker of service name and waits for it to return. A running deploy is finished first, but
+// its probes (see probeDeploy) are cut short.
+func (t *Tracker) stop(name string) {
+	tr, ok := t.running[name]
+	if !ok {
+		return
+	}
+	tr.cancel()
+	<-tr.done
+	delete(t.running, name)
+}
+
+// equal returns true if s and t have the same configuration, including the labels generated for the proxy.
+func (s *Service) equal(t *Service) bool {
+	a, err := toml.Marshal(s)
+	if err != nil {
+		return false
+	}
+	b, err := toml.Marshal(t)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(a, b) && reflect.DeepEqual(s.labels, t.labels)
+}
@@ -0,0 +1,172 @@
+package conf
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/pgo/compose"
+	"github.com/miekg/pgo/git"
+	"github.com/miekg/pgo/metric"
+)
+
+const reloadConf = `
+[[services]]
+name = "a"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/a"
+urls = { "a.example.org" = "a:80" }
+
+[[services]]
+name = "b"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/b"
+env = [ "X=%s" ]
+
+[[services]]
+name = "proxy"
+user = "miekg"
+repository = "https://gitlab.science.ru.nl/bla/proxy"
+import = "Caddyfile-import"
+reload = "localhost:caddy//exec caddy reload"
+`
+
+// newTestTracker returns a Tracker that uses fake git repositories and compose runners and that records which
+// services are tracking.
+func newTestTracker(t *testing.T) (*Tracker, *sync.Map, *[]string) {
+	dir := t.TempDir()
+	tr := NewTracker(dir, dir, 0)
+	tracking := &sync.Map{}
+	stale := &[]string{}
+	tr.init = func(_ context.Context, s *Service) error {
+		s.dir = filepath.Join(dir, s.Name)
+		os.MkdirAll(s.dir, 0755)
+		s.Git = git.NewFake()
+		s.Compose = compose.New(s.Name, s.User, s.dir, "", dir, nil, nil, nil, "")
+		s.Compose.SetRunner(compose.NewFake())
+		return nil
+	}
+	tr.track = func(ctx context.Context, s *Service) {
+		tracking.Store(s.Name, s)
+		<-ctx.Done()
+		tracking.Delete(s.Name)
+	}
+	tr.stale = func(c *Config) error {
+		*stale = []string{}
+		for _, s := range c.Services {
+			*stale = append(*stale, s.Name)
+		}
+		return nil
+	}
+	return tr, tracking, stale
+}
+
+func TestReload(t *testing.T) {
+	tr, tracking, stale := newTestTracker(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer func() { cancel(); tr.Wait() }()
+
+	c, err := Parse([]byte(strings.Replace(reloadConf, "%s", "1", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Reload(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	a, b, proxy := c.Services[0], c.Services[1], c.Services[2]
+	metric.ProbeSuccess.WithLabelValues("proxy", "https://p.example.org/").Set(1)
+	metric.ProbeSuccess.WithLabelValues("a", "https://a.example.org/").Set(1)
+
+	// b is modified, a has a new url and c is added
+	conf2 := strings.Replace(reloadConf, "%s", "2", 1)
+	conf2 = strings.Replace(conf2, `urls = { "a.example.org" = "a:80" }`, `urls = { "a.example.org" = "a:80" }
+[[services.routes]]
+host = "c.example.org"
+target = "a:80"`, 1)
+	c2, err := Parse([]byte(conf2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2.Services = c2.Services[:2] // and proxy is removed
+	if err := tr.Reload(ctx, c2); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tracking.Load("proxy"); ok {
+		t.Errorf("expected removed service to stop tracking")
+	}
+	if metric.ProbeSuccess.DeleteLabelValues("proxy", "https://p.example.org/") {
+		t.Errorf("expected the probe metrics of the removed service to be deleted")
+	}
+	if metric.ProbeSuccess.DeleteLabelValues("a", "https://a.example.org/") {
+		t.Errorf("expected the probe metrics of the modified service to be deleted")
+	}
+	if got := strings.Join(*stale, " "); got != "a b" {
+		t.Errorf("expected Stale to keep a and b, got %q", got)
+	}
+
+	c3, err := Parse([]byte(conf2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Reload(ctx, c3); err != nil {
+		t.Fatal(err)
+	}
+	got := tr.Config().Services
+	if got[0] == a || got[1] == b {
+		t.Errorf("expected modified services to be replaced")
+	}
+	if got[1] != c2.Services[1] {
+		t.Errorf("expected unmodified service to be kept")
+	}
+	if got[2] == proxy {
+		t.Errorf("expected re-added service to be new")
+	}
+	for i := 0; i < 100; i++ { // trackers are started asynchronously
+		names := []string{}
+		tracking.Range(func(k, v any) bool { names = append(names, k.(string)); return true })
+		sort.Strings(names)
+		if strings.Join(names, " ") == "a b proxy" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expected all services to be tracking")
+}
+
+func TestReloadImport(t *testing.T) {
+	tr, _, _ := newTestTracker(t)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer func() { cancel(); tr.Wait() }()
+
+	c, err := Parse([]byte(strings.Replace(reloadConf, "%s", "1", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Reload(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+	proxy := c.Services[2]
+
+	c2, err := Parse([]byte(strings.Replace(strings.Replace(reloadConf, "%s", "1", 1), "a.example.org", "z.example.org", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Reload(ctx, c2); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Config().Services[2] != proxy {
+		t.Fatalf("expected the proxy service to be kept")
+	}
+	buf, err := os.ReadFile(filepath.Join(proxy.dir, proxy.Import))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(buf), "z.example.org") || strings.Contains(string(buf), "a.example.org") {
+		t.Errorf("expected regenerated import file, got %s", buf)
+	}
+}
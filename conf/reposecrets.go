@@ -0,0 +1,105 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"filippo.io/age"
+	"github.com/miekg/pgo/osutil"
+	"go.science.ru.nl/log"
+)
+
+const (
+	_SECRETSFILE = "secrets.age" // age encrypted secrets in the repository, NAME=value lines
+	_SECRETSDIR  = "secrets"     // directory in the service's datadir holding the decrypted secrets
+	_AGEKEYFILE  = ".age-key"    // age identity of the service, only readable by root
+)
+
+// loadIdentity reads the age identity of the service from file, or creates a new one if file doesn't exist.
+func loadIdentity(file string) (*age.X25519Identity, error) {
+	buf, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		id, err := age.GenerateX25519Identity()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(file, []byte(id.String()+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return id, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return age.ParseX25519Identity(strings.TrimSpace(string(buf)))
+}
+
+// Recipient returns the age public key of the service, the secrets file in the repository must be encrypted to
+// it.
+func (s *Service) Recipient() string {
+	if s.identity == nil {
+		return ""
+	}
+	return s.identity.Recipient().String()
+}
+
+// installSecrets decrypts the secrets file in the repository (if there is one) into the secrets directory in the
+// service's datadir. Each secret is written to its own file, named after the secret, that is only readable by
+// the service's user. Secrets that are no longer in the secrets file are removed.
+func (s *Service) installSecrets() error {
+	enc, err := os.ReadFile(path.Join(s.dir, _SECRETSFILE))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.identity == nil {
+		return fmt.Errorf("no identity to decrypt %q", _SECRETSFILE)
+	}
+	secrets, err := decrypt(enc, s.identity)
+	if err != nil {
+		return fmt.Errorf("decrypting %q: %s", _SECRETSFILE, err)
+	}
+
+	dir := path.Join(s.datadir, _SECRETSDIR)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// The datadir is owned by the service's user, who could plant symlinks in it: don't follow those as root.
+	d, err := osutil.OpenDir(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	uid, gid := -1, -1
+	if os.Geteuid() == 0 {
+		u, g := osutil.User(s.User)
+		uid, gid = int(u), int(g)
+		if err := d.Chown(uid, gid); err != nil {
+			return err
+		}
+	}
+	for name, value := range secrets {
+		if name == "" || strings.HasPrefix(name, ".") || strings.Contains(name, "/") {
+			return fmt.Errorf("bad secret name %q", name)
+		}
+		if err := osutil.WriteFileAt(d, name, []byte(value), 0600, uid, gid); err != nil {
+			return err
+		}
+	}
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, ok := secrets[name]; !ok {
+			syscall.Unlinkat(int(d.Fd()), name)
+		}
+	}
+	log.Infof("[%s]: Installed %d secrets in %q", s.Name, len(secrets), dir)
+	return nil
+}
@@ -0,0 +1,197 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"go.science.ru.nl/log"
+)
+
+// Route routes requests for a host (and optionally a path) to a container of the service.
+type Route struct {
+	Host            string            `toml:"host"`                       // i.e. "example.org"
+	Path            string            `toml:"path,omitempty"`             // i.e. "/api/*", all paths when empty
+	Target          string            `toml:"target"`                     // host:port of the container
+	Aliases         []string          `toml:"aliases,omitempty"`          // extra hosts that redirect to Host
+	Headers         map[string]string `toml:"headers,omitempty"`          // request headers to set, "-Name" deletes
+	ResponseHeaders map[string]string `toml:"response_headers,omitempty"` // response headers to set, "-Name" deletes
+	BasicAuth       map[string]string `toml:"basic_auth,omitempty"`       // user -> bcrypt hashed password
+	Allow           []string          `toml:"allow,omitempty"`            // IP addresses or prefixes allowed, all when empty
+	Encode          []string          `toml:"encode,omitempty"`           // response encodings: "gzip" and/or "zstd"
+	TLS             string            `toml:"tls,omitempty"`              // "internal" for certificates from Caddy's internal CA, applies to all routes of Host
+
+	invalid atomic.Bool // the target doesn't check out against the compose project, see checkRoutes
+}
+
+func (r *Route) parse() error {
+	if r.Host == "" || strings.ContainsAny(r.Host, " \t/{}") {
+		return fmt.Errorf("bad host %q", r.Host)
+	}
+	if _, err := url.Parse("https://" + r.Host); err != nil {
+		return fmt.Errorf("bad host %q", r.Host)
+	}
+	if r.Path != "" && (!strings.HasPrefix(r.Path, "/") || strings.ContainsAny(r.Path, " \t{}")) {
+		return fmt.Errorf("bad path %q for %s, must start with /", r.Path, r.Host)
+	}
+	if _, _, err := net.SplitHostPort(r.Target); err != nil {
+		return fmt.Errorf("bad service:port %q for %s", r.Target, r.Host)
+	}
+	for _, a := range r.Aliases {
+		if a == "" || a == r.Host || strings.ContainsAny(a, " \t/{}") {
+			return fmt.Errorf("bad alias %q for %s", a, r.Host)
+		}
+	}
+	for _, h := range []map[string]string{r.Headers, r.ResponseHeaders} {
+		for k, v := range h {
+			if k == "" || strings.ContainsAny(strings.TrimPrefix(k, "-"), " \t:{}\"") || strings.ContainsAny(v, "\n\"") {
+				return fmt.Errorf("bad header %q for %s", k, r.Host)
+			}
+		}
+	}
+	for u, h := range r.BasicAuth {
+		if u == "" || strings.ContainsAny(u, " \t{}") || !strings.HasPrefix(h, "$2") {
+			return fmt.Errorf("bad basic_auth for user %q for %s, password must be bcrypt hashed", u, r.Host)
+		}
+	}
+	for _, a := range r.Allow {
+		if _, err := netip.ParsePrefix(a); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(a); err != nil {
+			return fmt.Errorf("bad allow %q for %s", a, r.Host)
+		}
+	}
+	for _, e := range r.Encode {
+		if e != "gzip" && e != "zstd" {
+			return fmt.Errorf("bad encode %q for %s, must be %q or %q", e, r.Host, "gzip", "zstd")
+		}
+	}
+	if r.TLS != "" && r.TLS != "internal" {
+		return fmt.Errorf("bad tls %q for %s, must be %q", r.TLS, r.Host, "internal")
+	}
+	return nil
+}
+
+// parseRoutes checks the routes of s and adds a route for each of its urls, and sorts them. Routes for the same
+// host must have unique paths.
+func (s *Service) parseRoutes() error {
+	for _, r := range s.Routes {
+		if r == nil {
+			return fmt.Errorf("incomplete route definition")
+		}
+	}
+	for u, target := range s.URLs {
+		s.Routes = append(s.Routes, &Route{Host: u, Target: target})
+	}
+	sortRoutes(s.Routes)
+
+	paths := map[string]bool{}
+	for _, r := range s.Routes {
+		if err := r.parse(); err != nil {
+			return err
+		}
+		if paths[r.Host+r.Path] {
+			return fmt.Errorf("duplicate route for %s%s", r.Host, r.Path)
+		}
+		paths[r.Host+r.Path] = true
+	}
+	return nil
+}
+
+// sortRoutes sorts routes on host and then on path, longest (most specific) first, so a route for all paths
+// comes last.
+func sortRoutes(routes []*Route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].Host != routes[j].Host {
+			return routes[i].Host < routes[j].Host
+		}
+		if len(routes[i].Path) != len(routes[j].Path) {
+			return len(routes[i].Path) > len(routes[j].Path)
+		}
+		return routes[i].Path < routes[j].Path
+	})
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// uniqueHosts returns an error if a host (or alias) is used by the routes of more than one service.
+func uniqueHosts(sx []*Service) error {
+	hosts := map[string]string{}
+	for _, s := range sx {
+		for _, r := range s.Routes {
+			for _, h := range append([]string{r.Host}, r.Aliases...) {
+				if name, ok := hosts[h]; ok && name != s.Name {
+					return fmt.Errorf("host %s is used by services %q and %q", h, name, s.Name)
+				}
+				hosts[h] = s.Name
+			}
+		}
+	}
+	return nil
+}
+
+// targets returns the targets of the routes of s.
+func (s *Service) targets() []string {
+	targets := []string{}
+	for _, r := range s.Routes {
+		targets = append(targets, r.Target)
+	}
+	return targets
+}
+
+// checkRoutes checks the targets of the routes of s against the compose project, routes with bad targets are
+// invalid and left out of the import file and the labels until they are fixed. If the compose project doesn't
+// load, the routes are left alone.
+func (s *Service) checkRoutes() {
+	bad, err := s.Compose.BadTargets()
+	if err != nil {
+		log.Warningf("[%s]: Failed to check route targets: %v", s.Name, err)
+		return
+	}
+	for _, r := range s.Routes {
+		err := bad[r.Target]
+		if err != nil {
+			s.violated(err)
+			log.Warningf("[%s]: Route for %s%s is left out of the proxy config: %v", s.Name, r.Host, r.Path, err)
+		}
+		r.invalid.Store(err != nil)
+	}
+	s.relabel()
+}
+
+// relabel regenerates the labels of s from its valid routes and sets them on the compose project.
+func (s *Service) relabel() {
+	if s.labeler == "" {
+		return
+	}
+	labels, err := Proxies[s.labeler].Labels(s.Name, s.Routes)
+	if err != nil {
+		log.Warningf("[%s]: Failed to generate labels: %v", s.Name, err)
+		return
+	}
+	s.Compose.SetLabels(labels)
+}
+
+// valid returns the routes that are not invalid.
+func valid(routes []*Route) []*Route {
+	v := make([]*Route, 0, len(routes))
+	for _, r := range routes {
+		if !r.invalid.Load() {
+			v = append(v, r)
+		}
+	}
+	return v
+}
@@ -0,0 +1,174 @@
+package conf
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/miekg/pgo/compose"
+)
+
+// Prefixes of values in the config that reference a secret instead of holding it.
+const (
+	_FILEREF   = "@file:"   // @file:/etc/pgo/secrets/db, the contents of the file
+	_SECRETREF = "@secret:" // @secret:DB_PASS, the value of DB_PASS in the encrypted secrets file
+)
+
+// _CHECKVALUE is what references resolve to when only their syntax is checked, it's valid base64.
+const _CHECKVALUE = "cGdvLWNoZWNr"
+
+// resolver resolves secret references in config values.
+type resolver struct {
+	secrets   map[string]string // decrypted secrets file
+	sources   []string          // the files the secrets came from
+	check     bool              // only check the syntax of references, nothing is read, see ParseCheck
+	encrypted bool              // there is a secrets file, used when checking
+}
+
+// newResolver returns a resolver, if secrets is not empty it's decrypted with the age identity (the host key) in
+// identity. The decrypted file holds NAME=value lines, empty lines and lines starting with # are skipped. With
+// check the identity and secrets files are not read, they are root only.
+func newResolver(secrets, identity string, check bool) (*resolver, error) {
+	r := &resolver{secrets: map[string]string{}, check: check, encrypted: secrets != ""}
+	if secrets == "" {
+		return r, nil
+	}
+	if identity == "" {
+		return nil, fmt.Errorf("secrets %q need an identity", secrets)
+	}
+	if check {
+		return r, nil
+	}
+	info, err := os.Stat(identity)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("identity %q is accessible by others: %s", identity, info.Mode().Perm())
+	}
+	id, err := os.ReadFile(identity)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := age.ParseIdentities(bytes.NewReader(id))
+	if err != nil {
+		return nil, fmt.Errorf("identity %q: %s", identity, err)
+	}
+	enc, err := os.ReadFile(secrets)
+	if err != nil {
+		return nil, err
+	}
+	if r.secrets, err = decrypt(enc, ids...); err != nil {
+		return nil, fmt.Errorf("decrypting secrets %q: %s", secrets, err)
+	}
+	r.sources = append(r.sources, secrets, identity)
+	return r, nil
+}
+
+// decrypt decrypts the age encrypted (and optionally armored) enc with ids, and parses the NAME=value lines.
+func decrypt(enc []byte, ids ...age.Identity) (map[string]string, error) {
+	var in io.Reader = bytes.NewReader(enc)
+	if bytes.HasPrefix(enc, []byte(armor.Header)) {
+		in = armor.NewReader(in)
+	}
+	plain, err := age.Decrypt(in, ids...)
+	if err != nil {
+		return nil, err
+	}
+	secrets := map[string]string{}
+	scanner := bufio.NewScanner(plain)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected NAME=value") // don't echo the line
+		}
+		secrets[strings.TrimSpace(name)] = value
+	}
+	return secrets, scanner.Err()
+}
+
+func isRef(v string) bool { return strings.HasPrefix(v, _FILEREF) || strings.HasPrefix(v, _SECRETREF) }
+
+// resolve returns the secret v references, or v itself if it isn't a reference. A file's trailing newline is
+// removed.
+func (r *resolver) resolve(v string) (string, error) {
+	if r.check {
+		return r.checkRef(v)
+	}
+	switch {
+	case strings.HasPrefix(v, _FILEREF):
+		file := v[len(_FILEREF):]
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		r.sources = append(r.sources, file)
+		return strings.TrimRight(string(buf), "\r\n"), nil
+	case strings.HasPrefix(v, _SECRETREF):
+		name := v[len(_SECRETREF):]
+		s, ok := r.secrets[name]
+		if !ok {
+			return "", fmt.Errorf("secret %q not found", name)
+		}
+		return s, nil
+	}
+	return v, nil
+}
+
+// checkRef checks the syntax of the reference v without reading anything, and returns _CHECKVALUE for it, or v
+// itself if it isn't a reference.
+func (r *resolver) checkRef(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, _FILEREF):
+		if file := v[len(_FILEREF):]; !path.IsAbs(file) {
+			return "", fmt.Errorf("file %q must be an absolute path", file)
+		}
+		return _CHECKVALUE, nil
+	case strings.HasPrefix(v, _SECRETREF):
+		name := v[len(_SECRETREF):]
+		if name == "" || strings.ContainsAny(name, "= \t") {
+			return "", fmt.Errorf("bad secret name %q", name)
+		}
+		if !r.encrypted {
+			return "", fmt.Errorf("secret %q not found, there is no secrets file", name)
+		}
+		return _CHECKVALUE, nil
+	}
+	return v, nil
+}
+
+// env resolves the value of the environment variable e, in VAR=VALUE notation.
+func (r *resolver) env(e string) (string, error) {
+	name, value, ok := strings.Cut(e, "=")
+	if !ok {
+		return e, nil
+	}
+	value, err := r.resolve(value)
+	return name + "=" + value, err
+}
+
+// registry resolves the token of the registry reg, in [user:]token@registry notation.
+func (r *resolver) registry(reg string) (string, error) {
+	cred, host, ok := compose.SplitRegistry(reg)
+	if !ok {
+		return reg, nil
+	}
+	user := ""
+	if !isRef(cred) {
+		if u, t, ok := strings.Cut(cred, ":"); ok {
+			user, cred = u+":", t
+		}
+	}
+	token, err := r.resolve(cred)
+	return user + token + "@" + host, err
+}
@@ -0,0 +1,82 @@
+package conf
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/pgo/logfile"
+	"github.com/miekg/pgo/osutil"
+)
+
+// status is the state of the tracking routine of a service.
+type status struct {
+	mu       sync.Mutex
+	ready    bool      // initial check out and deploy are done
+	deployed time.Time // last successful deploy
+}
+
+// Status is the state of a service as reported by the status API.
+type Status struct {
+	Name         string         `json:"name"`
+	Repository   string         `json:"repository"`
+	Branch       string         `json:"branch"`
+	Hash         string         `json:"hash"`
+	LastDeploy   *time.Time     `json:"last_deploy,omitempty"`
+	Ready        bool           `json:"ready"`
+	ForcedDown   bool           `json:"forced_down"`
+	CrashLooping bool           `json:"crash_looping"`
+	Containers   map[string]int `json:"containers"` // number of containers per state
+}
+
+// Ready returns true if the initial check out and deploy of the service are done.
+func (s *Service) Ready() bool {
+	s.st.mu.Lock()
+	defer s.st.mu.Unlock()
+	return s.st.ready
+}
+
+// Ready returns true if all services are ready.
+func (c *Config) Ready() bool {
+	for _, s := range c.Services {
+		if !s.Ready() {
+			return false
+		}
+	}
+	return true
+}
+
+// Status returns the status of the service. Credentials in the repository are redacted.
+func (s *Service) Status() Status {
+	st := Status{
+		Name:         s.Name,
+		Repository:   osutil.Redact(s.Repository),
+		Branch:       s.Branch,
+		Ready:        s.Ready(),
+		CrashLooping: s.CrashLooping(),
+		Containers:   map[string]int{},
+	}
+	if st.Ready {
+		st.Hash = s.Git.Hash()
+	}
+	s.st.mu.Lock()
+	if !s.st.deployed.IsZero() {
+		t := s.st.deployed
+		st.LastDeploy = &t
+	}
+	s.st.mu.Unlock()
+
+	_, err := os.Stat(s.dir + _STOPFILE) // not IsForcedDown, that logs
+	st.ForcedDown = !errors.Is(err, os.ErrNotExist)
+
+	if cs, err := s.Compose.Containers(); err == nil {
+		for _, c := range cs {
+			st.Containers[c.State]++
+		}
+	}
+	return st
+}
+
+// Log returns the last n lines of the structured log of the service.
+func (s *Service) Log(n int) ([]byte, error) { return logfile.Tail(s.dir+_LOGFILE, n) }
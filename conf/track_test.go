@@ -0,0 +1,252 @@
+package conf
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/pgo/compose"
+	"github.com/miekg/pgo/git"
+	"github.com/miekg/pgo/metric"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestService returns a service that uses a fake git repository and a fake compose runner.
+func newTestService(t *testing.T) (*Service, *git.Fake, *compose.Fake) {
+	dir := t.TempDir()
+	f := git.NewFake()
+	r := compose.NewFake()
+	s := &Service{
+		Name:    "test",
+		User:    "test",
+		Branch:  "main",
+		Git:     f,
+		Compose: compose.New("test", "test", dir, "", dir, nil, nil, nil, ""),
+		dir:     dir,
+		datadir: dir,
+	}
+	s.Compose.SetRunner(r)
+	return s, f, r
+}
+
+func TestTrack(t *testing.T) {
+	s, f, r := newTestService(t)
+	f.Commit("0123456789abcdef", "compose.yaml")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	go func() {
+		// after the initial pull, commit a change to the compose file, this must down and up the service
+		for f.Pulls() < 2 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		f.Commit("fedcba9876543210", "compose.yaml")
+	}()
+	s.Track(ctx, 10*time.Millisecond)
+
+	if !f.IsCheckedOut() {
+		t.Fatal("expected repository to be checked out")
+	}
+	if f.Pulls() < 2 {
+		t.Fatalf("expected at least 2 pulls, got %d", f.Pulls())
+	}
+	if h := s.Git.Hash(); h != "fedcba98" {
+		t.Fatalf("expected hash %q, got %q", "fedcba98", h)
+	}
+	subs := r.Subcommands()
+	if len(subs) < 2 || subs[0] != "pull" || subs[1] != "up" {
+		t.Fatalf("expected pull and up on start, got %v", subs)
+	}
+	downs := 0
+	for _, s := range subs {
+		if s == "down" {
+			downs++
+		}
+	}
+	if downs != 1 {
+		t.Fatalf("expected 1 down after the compose file changed, got %d: %v", downs, subs)
+	}
+
+	if x := testutil.ToFloat64(metric.GitInfo.WithLabelValues("test", "fedcba98")); x != 1 {
+		t.Errorf("expected git info for hash %q, got %f", "fedcba98", x)
+	}
+	if x := testutil.CollectAndCount(metric.GitInfo); x != 1 {
+		t.Errorf("expected only the current hash in git info, got %d", x)
+	}
+	if x := testutil.ToFloat64(metric.DeployTimestamp.WithLabelValues("test")); x == 0 {
+		t.Error("expected last successful deploy to be set")
+	}
+
+	st := s.Status()
+	if !st.Ready || st.Hash != "fedcba98" || st.LastDeploy == nil || st.ForcedDown {
+		t.Errorf("expected ready, deployed service on %q, got %+v", "fedcba98", st)
+	}
+}
+
+func TestTrackTransient(t *testing.T) {
+	s, f, _ := newTestService(t)
+	if err := f.Checkout(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	f.Err = git.ErrNetwork
+	if s.Ready() {
+		t.Fatal("expected service not to be ready before tracking")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	s.Track(ctx, 10*time.Millisecond)
+
+	if f.Pulls() < 2 {
+		t.Fatalf("expected at least 2 pulls, got %d", f.Pulls())
+	}
+	if f.Removes() != 0 {
+		t.Fatalf("expected no removal of the repository on transient errors, got %d", f.Removes())
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s, _, r := newTestService(t)
+
+	// a kill followed by a die is a stop, not a crash
+	s.event(context.Background(), compose.Event{ID: "a", Action: "kill", Service: "web"})
+	s.event(context.Background(), compose.Event{ID: "a", Action: "die", Service: "web"})
+	if s.CrashLooping() {
+		t.Fatal("expected no crash loop after a stop")
+	}
+	for i := 0; i < _CRASHLOOPDIES-1; i++ {
+		s.event(context.Background(), compose.Event{ID: "a", Action: "die", Service: "web"})
+	}
+	if s.CrashLooping() {
+		t.Fatalf("expected no crash loop after %d dies", _CRASHLOOPDIES-1)
+	}
+	s.event(context.Background(), compose.Event{ID: "a", Action: "die", Service: "web"})
+	if !s.CrashLooping() {
+		t.Fatalf("expected crash loop after %d dies", _CRASHLOOPDIES)
+	}
+	if x := testutil.ToFloat64(metric.CrashLooping.WithLabelValues("test")); x != 1 {
+		t.Errorf("expected crash looping metric to be 1, got %f", x)
+	}
+	if x := testutil.ToFloat64(metric.ContainerEventCount.WithLabelValues("test", "die")); x != _CRASHLOOPDIES+1 {
+		t.Errorf("expected %d die events, got %f", _CRASHLOOPDIES+1, x)
+	}
+	if subs := r.Subcommands(); len(subs) != 0 {
+		t.Fatalf("expected no remediation without a remediate config, got %v", subs)
+	}
+}
+
+func TestRemediate(t *testing.T) {
+	notified := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n struct{ Service, Message string }
+		json.NewDecoder(r.Body).Decode(&n)
+		notified <- n.Service
+	}))
+	defer srv.Close()
+
+	s, _, r := newTestService(t)
+	s.Remediate = &Remediate{Budget: 2, Notify: srv.URL}
+	if err := s.Remediate.parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.dmu.Lock() // being deployed
+	s.event(context.Background(), compose.Event{ID: "a", Action: "die", Service: "web"})
+	s.dmu.Unlock()
+	if subs := r.Subcommands(); len(subs) != 0 {
+		t.Fatalf("expected no remediation during a deploy, got %v", subs)
+	}
+
+	s.event(context.Background(), compose.Event{ID: "a", Action: "die", Service: "web"})
+	s.event(context.Background(), compose.Event{ID: "b", Action: "health_status: unhealthy", Service: "db"})
+	s.event(context.Background(), compose.Event{ID: "a", Action: "die", Service: "web"}) // over budget
+	s.event(context.Background(), compose.Event{ID: "a", Action: "die", Service: "web"}) // over budget, notified only once
+
+	subs := r.Subcommands()
+	if len(subs) != 2 || subs[0] != "up" || subs[1] != "restart" {
+		t.Fatalf("expected up and restart, got %v", subs)
+	}
+	if len(notified) != 1 {
+		t.Fatalf("expected 1 notification, got %d", len(notified))
+	}
+	if n := <-notified; n != "test" {
+		t.Errorf("expected notification for service %q, got %q", "test", n)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	hosts := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	s, _, r := newTestService(t)
+	s.Routes = []*Route{{Host: "a.invalid", Path: "/api/*", Target: "web:" + port}}
+	s.Probe = &Probe{Timeout: "1s", Internal: true, Deploy: "1ns"}
+	if err := s.Probe.parse(); err != nil {
+		t.Fatal(err)
+	}
+	const comp = "services:\n  web:\n    image: busybox\n    networks: [proxy, internal]\nnetworks:\n  proxy:\n    external: true\n    name: reverse_proxy\n  internal:\n"
+	if err := os.WriteFile(filepath.Join(s.dir, "compose.yaml"), []byte(comp), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// only the address on the external network works
+	r.SetContainers(compose.Container{ID: "a", Service: "web", State: "running", Networks: map[string]string{"reverse_proxy": "127.0.0.1", "test_internal": "192.0.2.1"}})
+
+	// the public URL doesn't resolve, the internal one goes to srv
+	failed := s.probeAll(context.TODO())
+	if len(failed) != 1 || failed[0] != "https://a.invalid/api/" {
+		t.Fatalf("expected public probe to fail, got %v", failed)
+	}
+	if h := <-hosts; h != "a.invalid" {
+		t.Errorf("expected Host header %q, got %q", "a.invalid", h)
+	}
+	internal := "http://web:" + port + "/api/"
+	if v := testutil.ToFloat64(metric.ProbeSuccess.WithLabelValues("test", internal)); v != 1 {
+		t.Errorf("expected internal probe to succeed, got %v", v)
+	}
+
+	status.Store(http.StatusBadGateway)
+	s.probeAll(context.TODO())
+	<-hosts
+	if v := testutil.ToFloat64(metric.ProbeStatus.WithLabelValues("test", internal)); v != http.StatusBadGateway {
+		t.Errorf("expected status %d, got %v", http.StatusBadGateway, v)
+	}
+	if v := testutil.ToFloat64(metric.ProbeSuccess.WithLabelValues("test", internal)); v != 0 {
+		t.Errorf("expected internal probe to fail, got %v", v)
+	}
+	if err := s.probeDeploy(context.Background()); err == nil {
+		t.Errorf("expected failing probes to fail the deploy")
+	}
+}
+
+func TestProbeCert(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	status, expiry, err := probe(context.TODO(), probeURL{url: srv.URL, insecure: true}, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, status)
+	}
+	if !expiry.Equal(srv.Certificate().NotAfter) {
+		t.Errorf("expected certificate expiry %s, got %s", srv.Certificate().NotAfter, expiry)
+	}
+	if _, _, err := probe(context.TODO(), probeURL{url: srv.URL}, "", time.Second); err == nil {
+		t.Errorf("expected error for unverified certificate")
+	}
+}
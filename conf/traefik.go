@@ -0,0 +1,115 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// traefik generates Traefik (v3) labels for the compose services the routes point to, it has no import file.
+// tls "internal" makes Traefik use its default certificate. Invalid routes, see checkRoutes, get no labels.
+type traefik struct{}
+
+func (traefik) Import([]*Route) ([]byte, error) { return nil, nil }
+
+func (traefik) Labels(name string, routes []*Route) (map[string]map[string]string, error) {
+	labels := map[string]map[string]string{}
+	for i, r := range routes {
+		if r.invalid.Load() {
+			continue
+		}
+		svc, port, err := net.SplitHostPort(r.Target)
+		if err != nil {
+			return nil, err
+		}
+		l := labels[svc]
+		if l == nil {
+			l = map[string]string{"traefik.enable": "true"}
+			labels[svc] = l
+		}
+		id := fmt.Sprintf("pgo-%s-%d", traefikName.ReplaceAllString(name, "-"), i)
+		router := "traefik.http.routers." + id + "."
+		mw := "traefik.http.middlewares." + id + "-"
+		middlewares := []string{}
+
+		l[router+"rule"] = traefikRule(r)
+		l[router+"service"] = id
+		l["traefik.http.services."+id+".loadbalancer.server.port"] = port
+		if r.TLS != "" {
+			l[router+"tls"] = "true"
+		}
+		if len(r.Aliases) > 0 {
+			as := make([]string, len(r.Aliases))
+			for i := range r.Aliases {
+				as[i] = regexp.QuoteMeta(r.Aliases[i])
+			}
+			sort.Strings(as)
+			l[mw+"redirect.redirectregex.regex"] = "^https?://(" + strings.Join(as, "|") + ")/(.*)"
+			l[mw+"redirect.redirectregex.replacement"] = "https://" + r.Host + "/${2}"
+			l[mw+"redirect.redirectregex.permanent"] = "true"
+			middlewares = append(middlewares, id+"-redirect")
+		}
+		if len(r.Allow) > 0 {
+			l[mw+"allow.ipallowlist.sourcerange"] = strings.Join(r.Allow, ",")
+			middlewares = append(middlewares, id+"-allow")
+		}
+		if len(r.BasicAuth) > 0 {
+			users := []string{}
+			for _, u := range sortedKeys(r.BasicAuth) {
+				users = append(users, u+":"+r.BasicAuth[u])
+			}
+			l[mw+"auth.basicauth.users"] = strings.Join(users, ",")
+			middlewares = append(middlewares, id+"-auth")
+		}
+		if len(r.Headers)+len(r.ResponseHeaders) > 0 {
+			for k, v := range r.Headers {
+				l[mw+"headers.headers.customrequestheaders."+strings.TrimPrefix(k, "-")] = traefikHeader(k, v)
+			}
+			for k, v := range r.ResponseHeaders {
+				l[mw+"headers.headers.customresponseheaders."+strings.TrimPrefix(k, "-")] = traefikHeader(k, v)
+			}
+			middlewares = append(middlewares, id+"-headers")
+		}
+		if len(r.Encode) > 0 {
+			l[mw+"compress.compress.encodings"] = strings.Join(r.Encode, ",")
+			middlewares = append(middlewares, id+"-compress")
+		}
+		if len(middlewares) > 0 {
+			l[router+"middlewares"] = strings.Join(middlewares, ",")
+		}
+	}
+	return labels, nil
+}
+
+// traefikName matches the characters not allowed in the names of Traefik routers, services and middlewares.
+var traefikName = regexp.MustCompile(`[^a-zA-Z0-9-]`)
+
+// traefikRule returns the rule of the router for r: its host and aliases and its path.
+func traefikRule(r *Route) string {
+	hosts := []string{"Host(`" + r.Host + "`)"}
+	for _, a := range r.Aliases {
+		hosts = append(hosts, "Host(`"+a+"`)")
+	}
+	sort.Strings(hosts[1:])
+	rule := strings.Join(hosts, " || ")
+	if r.Path == "" {
+		return rule
+	}
+	if len(hosts) > 1 {
+		rule = "(" + rule + ")"
+	}
+	if path, all := prefix(r.Path); all {
+		return rule + " && PathPrefix(`" + path + "`)"
+	}
+	return rule + " && Path(`" + r.Path + "`)"
+}
+
+// traefikHeader returns the value for header k, an empty value removes the header.
+func traefikHeader(k, v string) string {
+	if strings.HasPrefix(k, "-") {
+		return ""
+	}
+	return v
+}
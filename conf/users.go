@@ -0,0 +1,62 @@
+package conf
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/miekg/pgo/osutil"
+	"go.science.ru.nl/log"
+)
+
+// _HOMEDIR is the directory, under the pgo directory, that holds the home directories of the users we create.
+const _HOMEDIR = ".home"
+
+// CreateUsers creates the users of the services in sx that don't exist yet. Their home directories are created
+// in dir/.home.
+func CreateUsers(sx []*Service, dir string) error {
+	home := path.Join(dir, _HOMEDIR)
+	if err := os.MkdirAll(home, 0755); err != nil {
+		return err
+	}
+	for _, s := range sx {
+		if uid, _ := osutil.User(s.User); uid != 0 || s.User == "root" {
+			continue
+		}
+		log.Infof("[%s]: Creating user %q", s.Name, s.User)
+		if err := osutil.AddUser(s.User, path.Join(home, s.User)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// staleUsers removes the users we've created (those with a home directory in dir/.home) that are not used by any
+// of the services in sx.
+func staleUsers(sx []*Service, dir string) {
+	homes, err := filepath.Glob(path.Join(dir, _HOMEDIR, "*"))
+	if err != nil {
+		return
+	}
+Homes:
+	for _, h := range homes {
+		u := filepath.Base(h)
+		for i := range sx {
+			if sx[i].User == u {
+				continue Homes
+			}
+		}
+		if !osutil.IsOurs(u) {
+			continue
+		}
+		log.Infof("Removing (stale) user %q", u)
+		if err := osutil.DelUser(u); err != nil {
+			log.Warningf("Failed to remove (stale) user %q: %s", u, err)
+		}
+	}
+}
+
+// isStateDir returns true if the directory entry name in the pgo directory isn't a service, but holds state of
+// pgod itself, like _HOMEDIR.
+func isStateDir(name string) bool { return strings.HasPrefix(name, ".") }
@@ -0,0 +1,97 @@
+package git
+
+import (
+	"context"
+	"sync"
+)
+
+// Fake is an in-memory Repo to be used in tests, it doesn't need the git binary nor network access. Use Commit
+// to add upstream commits, these are picked up on the next Pull.
+type Fake struct {
+	// Err, when set, is returned from Checkout and Pull.
+	Err error
+
+	mu         sync.Mutex
+	checkedout bool
+	head       string
+	upstream   []fakeCommit // commits not yet pulled
+	pulls      int
+	removes    int
+}
+
+type fakeCommit struct {
+	hash  string
+	paths []string
+}
+
+// NewFake returns a pointer to an initialized Fake.
+func NewFake() *Fake { return &Fake{} }
+
+// Commit adds a commit with hash, that changes paths, to upstream.
+func (f *Fake) Commit(hash string, paths ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.upstream = append(f.upstream, fakeCommit{hash: hash, paths: paths})
+}
+
+// Pulls returns the number of times Pull has been called.
+func (f *Fake) Pulls() int { f.mu.Lock(); defer f.mu.Unlock(); return f.pulls }
+
+// Removes returns the number of times RemoveAll has been called.
+func (f *Fake) Removes() int { f.mu.Lock(); defer f.mu.Unlock(); return f.removes }
+
+func (f *Fake) IsCheckedOut() bool { f.mu.Lock(); defer f.mu.Unlock(); return f.checkedout }
+
+func (f *Fake) Checkout(context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.checkedout {
+		return nil
+	}
+	if f.Err != nil {
+		return f.Err
+	}
+	f.checkedout = true
+	return nil
+}
+
+func (f *Fake) Pull(_ context.Context, names []string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pulls++
+	if f.Err != nil {
+		return false, f.Err
+	}
+	changed := []string{}
+	for _, c := range f.upstream {
+		f.head = c.hash
+		changed = append(changed, c.paths...)
+	}
+	f.upstream = nil
+	return OfInterest(changed, names), nil
+}
+
+func (f *Fake) Hash() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.head) < 8 {
+		return ""
+	}
+	return f.head[:8]
+}
+
+func (f *Fake) Rollback(_ context.Context, hash string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.head = hash
+	return nil
+}
+func (f *Fake) Branch(context.Context, string) error { return nil }
+
+func (f *Fake) RemoveAll() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removes++
+	f.checkedout = false
+	return nil
+}
@@ -9,56 +9,74 @@ import (
 	"os/exec"
 	"path"
 	"strings"
+	"time"
 
+	"github.com/miekg/pgo/logfile"
 	"github.com/miekg/pgo/metric"
 	"github.com/miekg/pgo/osutil"
+	"github.com/miekg/pgo/tracing"
 	"go.science.ru.nl/log"
 )
 
+// Git is a Repo that uses the git binary, running as the configured user.
 type Git struct {
 	name     string
 	upstream string // upstream git repo
 	branch   string // specific branch to get, 'main' is not specified
 	user     string // what user to use
 	dir      string // where to put it
+
+	key        string // optional ssh deploy key
+	knownhosts string // known_hosts file to use with key
 }
 
-// New returns a pointer to an intialized Git.
-func New(name, upstream, user, branch, directory string) *Git {
+// New returns a pointer to an intialized Git. If key is not empty, it is used as the ssh key to access upstream,
+// with knownhosts as the only known_hosts file.
+func New(name, upstream, user, branch, directory, key, knownhosts string) *Git {
 	g := &Git{
-		name:     name,
-		upstream: upstream,
-		user:     user,
-		branch:   branch,
-		dir:      directory,
+		name:       name,
+		upstream:   upstream,
+		user:       user,
+		branch:     branch,
+		dir:        directory,
+		key:        key,
+		knownhosts: knownhosts,
 	}
 	return g
 }
 
-func (g *Git) run(args ...string) ([]byte, error) {
-	ctx := context.TODO()
-	cmd := exec.CommandContext(ctx, "git", args...)
-	if err := osutil.RunAs(cmd, g.user); err != nil {
+// run runs git with args as g's user, ctx carries the span the command is traced under, see tracing.Command.
+func (g *Git) run(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(context.TODO(), "git", args...)
+	if err := osutil.RunAs(cmd, g.user, ""); err != nil {
 		return nil, err
 	}
 	cmd.Dir = g.dir
-	cmd.Env = []string{"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_SYSTEM=/dev/null"}
+	cmd.Env = append(cmd.Env, "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_SYSTEM=/dev/null")
+	if g.key != "" {
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND="+sshCommand(g.key, g.knownhosts))
+	}
 
 	metric.CmdCount.WithLabelValues(g.name, "git", args[0]).Inc()
+	span := tracing.Command(ctx, g.name, "git "+args[0])
+	start := time.Now()
 
-	log.Debugf("[%s]: running in %q as %q %v", g.name, cmd.Dir, g.user, cmd.Args)
+	log.Debugf("[%s]: running in %q as %q %s", g.name, cmd.Dir, g.user, osutil.Redact(fmt.Sprint(cmd.Args)))
 
 	out, err := cmd.CombinedOutput()
 	if len(out) > 0 {
-		log.Debugf("[%s]: %s", g.name, string(out))
+		log.Debugf("[%s]: %s", g.name, osutil.Redact(string(out)))
 	}
 	if err != nil {
 		metric.CmdErrorCount.WithLabelValues(g.name, "git", args[0]).Inc()
 	}
+	tracing.Exit(span, err)
+	logfile.Command(g.name, "git "+args[0], start, out, err)
 
 	return out, err
 }
 
+// IsCheckedOut returns true if g.dir has a .git subdirectory.
 func (g *Git) IsCheckedOut() bool {
 	info, err := os.Stat(path.Join(g.dir, ".git"))
 	if err != nil {
@@ -69,7 +87,7 @@ func (g *Git) IsCheckedOut() bool {
 
 // Checkout will do the initial check of the git repo. If the g.dir directory already exist and has
 // a .git subdirectory, it will assume the checkout has been done during a previuos run.
-func (g *Git) Checkout() error {
+func (g *Git) Checkout(ctx context.Context) error {
 	if g.IsCheckedOut() {
 		return nil
 	}
@@ -87,59 +105,81 @@ func (g *Git) Checkout() error {
 		}
 	}
 
-	_, err := g.run("clone", "--depth", "1", "-b", g.branch, g.upstream, g.dir)
-	return err
+	out, err := g.run(ctx, "clone", "--depth", "1", "-b", g.branch, g.upstream, g.dir)
+	return classify(out, err)
 }
 
-// Pull pulls from upstream. If the returned bool is true there were updates if on the files named in names.
-func (g *Git) Pull(names []string) (bool, error) {
-	if err := g.Stash(); err != nil {
+// Pull pulls from upstream. If the returned bool is true there were updates in files matching one of the
+// globs in names, see OfInterest.
+func (g *Git) Pull(ctx context.Context, names []string) (bool, error) {
+	if err := g.Stash(ctx); err != nil {
 		return false, err
 	}
 
-	out, err := g.run("pull", "--stat", "--rebase", "origin", g.branch)
+	before := g.head(ctx)
+	out, err := g.run(ctx, "pull", "--rebase", "origin", g.branch)
 	if err != nil {
-		// if err starts with: 'fatal: unable to access ' and ends with 'Connection refused' we assume a soft
-		// error and return false, nil
-		errmsg := strings.ToLower(err.Error())
-		if strings.HasPrefix(errmsg, "fatal: unable to access") && strings.HasSuffix(errmsg, "connection refused") {
-			log.Warningf("Error pulling repo: %s, treating as transient error and ignoring", errmsg)
-			return false, nil
-		}
-		// also softerr for: 'remote: HTTP Basic: Access denied. ....'
-		// fatal: Authentication failed for
-		if strings.HasPrefix(errmsg, "fatal: Authentication failed for") {
-			log.Warningf("Error pulling repo: %s, treating as transient error and ignoring", errmsg)
-			return false, nil
+		return false, classify(out, err)
+	}
+	after := g.head(ctx)
+	if before == "" || after == "" || before == after {
+		return false, nil
+	}
 
-		}
+	changed, err := g.Changed(ctx, before, after)
+	if err != nil {
 		return false, err
 	}
-	return g.OfInterest(out, names), nil
+	return OfInterest(changed, names), nil
 }
 
-// Hash returns the git hash of HEAD in the repo in g.dir. Empty string is returned in case of an error.
-// The hash is always truncated to 8 hex digits.
-func (g *Git) Hash() string {
-	out, err := g.run("rev-parse", "HEAD")
+// Changed returns the paths that differ between commit from and commit to. Renames are returned as a
+// deletion and an addition, so both the old and the new path are included.
+func (g *Git) Changed(ctx context.Context, from, to string) ([]string, error) {
+	out, err := g.run(ctx, "diff", "--name-only", "--no-renames", "-z", from, to)
+	if err != nil {
+		return nil, err
+	}
+	changed := []string{}
+	for _, p := range strings.Split(string(out), "\x00") {
+		if p != "" {
+			changed = append(changed, p)
+		}
+	}
+	return changed, nil
+}
+
+// head returns the full git hash of HEAD in the repo in g.dir. Empty string is returned in case of an error.
+func (g *Git) head(ctx context.Context) string {
+	out, err := g.run(ctx, "rev-parse", "HEAD")
 	if err != nil {
 		return ""
 	}
-	if len(out) < 8 {
+	return strings.TrimSpace(string(out))
+}
+
+// Hash returns the git hash of HEAD in the repo in g.dir. Empty string is returned in case of an error.
+// The hash is always truncated to 8 hex digits.
+func (g *Git) Hash() string {
+	hash := g.head(context.Background())
+	if len(hash) < 8 {
 		return ""
 	}
-	return string(out)[:8]
+	return hash[:8]
 }
 
 // Rollback checks out commit <hash>, and return nil if no errors are encountered.
-func (g *Git) Rollback(hash string) error {
-	if err := g.Stash(); err != nil {
+func (g *Git) Rollback(ctx context.Context, hash string) error {
+	if err := g.Stash(ctx); err != nil {
 		return err
 	}
-	_, err := g.run("checkout", hash)
+	_, err := g.run(ctx, "checkout", hash)
 	return err
 }
 
-func (g *Git) Stash() error           { _, err := g.run("stash"); return err }
-func (g *Git) Branch(br string) error { _, err := g.run("checkout", br); return err }
-func (g *Git) RemoveAll() error       { err := os.RemoveAll(g.dir); return err }
+func (g *Git) Stash(ctx context.Context) error { _, err := g.run(ctx, "stash"); return err }
+func (g *Git) Branch(ctx context.Context, br string) error {
+	_, err := g.run(ctx, "checkout", br)
+	return err
+}
+func (g *Git) RemoveAll() error { err := os.RemoveAll(g.dir); return err }
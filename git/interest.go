@@ -0,0 +1,39 @@
+package git
+
+import (
+	"path"
+	"strings"
+)
+
+// OfInterest returns true when one of the changed paths matches one of the globs in names.
+//
+// A glob is matched (with path.Match) against the path itself and against each of its parent directories,
+// so both "config" and "config/*" match "config/nginx/site.conf", while "compose.yaml" only matches
+// "compose.yaml" and not "old-compose.yaml".
+func OfInterest(changed, names []string) bool {
+	if len(names) == 0 {
+		return false
+	}
+	// this is O(n * m), but the number of globs is usually very small, and the number of changed paths is
+	// usually < 1000. So it's not too bad.
+	for _, c := range changed {
+		for _, n := range names {
+			if match(n, c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func match(glob, p string) bool {
+	glob = path.Clean(glob)
+	p = path.Clean(strings.TrimPrefix(p, "/"))
+	for p != "." && p != "/" {
+		if ok, _ := path.Match(glob, p); ok {
+			return true
+		}
+		p = path.Dir(p)
+	}
+	return false
+}
@@ -0,0 +1,427 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/miekg/pgo/logfile"
+	"github.com/miekg/pgo/metric"
+	"github.com/miekg/pgo/osutil"
+	"github.com/miekg/pgo/tracing"
+	"go.science.ru.nl/log"
+)
+
+// Native is a Repo that uses go-git, and doesn't need the git binary. All operations are done in-process, if
+// we are root the files are chown-ed to the configured user after the clone and whenever HEAD moved. As the user
+// owns the tree, root refuses to write in it when it has something that could redirect the writes, see safe.
+type Native struct {
+	name     string
+	upstream string // upstream git repo
+	branch   string // specific branch to get, 'main' is not specified
+	user     string // what user to use
+	dir      string // where to put it
+
+	key        string // optional ssh deploy key
+	knownhosts string // known_hosts file to use with key
+}
+
+// NewNative returns a pointer to an intialized Native. If key is not empty, it is used as the ssh key to access
+// upstream, with knownhosts as the only known_hosts file.
+func NewNative(name, upstream, user, branch, directory, key, knownhosts string) *Native {
+	n := &Native{
+		name:       name,
+		upstream:   upstream,
+		user:       user,
+		branch:     branch,
+		dir:        directory,
+		key:        key,
+		knownhosts: knownhosts,
+	}
+	return n
+}
+
+// do runs the git operation op, done by f, and updates the command metrics, traces and logs it like the commands
+// of Git. The returned err is classified, see nativeErr.
+func (n *Native) do(ctx context.Context, op string, f func() error) error {
+	metric.CmdCount.WithLabelValues(n.name, "git", op).Inc()
+	span := tracing.Command(ctx, n.name, "git "+op)
+	log.Debugf("[%s]: running in %q (native) %s %s", n.name, n.dir, op, osutil.Redact(n.upstream))
+
+	start := time.Now()
+	err := f()
+	if err != nil {
+		metric.CmdErrorCount.WithLabelValues(n.name, "git", op).Inc()
+	}
+	err = nativeErr(err)
+	tracing.Exit(span, err)
+	logfile.Command(n.name, "git "+op, start, nil, err)
+	return err
+}
+
+// IsCheckedOut returns true if n.dir has a .git subdirectory.
+func (n *Native) IsCheckedOut() bool {
+	info, err := os.Stat(path.Join(n.dir, ".git"))
+	if err != nil {
+		return false
+	}
+	return info.Name() == ".git" && info.IsDir()
+}
+
+// Checkout will do the initial check of the git repo. If the n.dir directory already exist and has
+// a .git subdirectory, it will assume the checkout has been done during a previuos run.
+func (n *Native) Checkout(ctx context.Context) error {
+	if n.IsCheckedOut() {
+		return nil
+	}
+
+	if err := os.MkdirAll(n.dir, 0775); err != nil {
+		log.Errorf("Directory %q can not be created", n.dir)
+		return fmt.Errorf("failed to create directory %q: %s", n.dir, err)
+	}
+	if info, err := os.Lstat(n.dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("%q is not a directory", n.dir)
+	}
+	if des, err := os.ReadDir(n.dir); err != nil || len(des) > 0 {
+		return fmt.Errorf("directory %q is not empty", n.dir)
+	}
+
+	auth, err := sshAuth(n.upstream, n.key, n.knownhosts)
+	if err != nil {
+		return err
+	}
+	err = n.do(ctx, "clone", func() error {
+		_, err := gogit.PlainClone(n.dir, false, &gogit.CloneOptions{
+			URL:           n.upstream,
+			Auth:          auth,
+			ReferenceName: plumbing.NewBranchReferenceName(n.branch),
+			SingleBranch:  true,
+			Depth:         1,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return n.chown()
+}
+
+// Pull fetches from upstream and resets the worktree to the upstream branch, local changes are discarded. If
+// the returned bool is true there were updates in files matching one of the globs in names, see OfInterest.
+func (n *Native) Pull(ctx context.Context, names []string) (bool, error) {
+	r, err := gogit.PlainOpen(n.dir)
+	if err != nil {
+		return false, err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return false, err
+	}
+
+	auth, err := sshAuth(n.upstream, n.key, n.knownhosts)
+	if err != nil {
+		return false, err
+	}
+	refspec := config.RefSpec(fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%[1]s", n.branch))
+	err = n.do(ctx, "fetch", func() error {
+		err := r.Fetch(&gogit.FetchOptions{RemoteName: "origin", RefSpecs: []config.RefSpec{refspec}, Depth: 1, Force: true, Auth: auth})
+		if errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	remote, err := r.Reference(plumbing.NewRemoteReferenceName("origin", n.branch), true)
+	if err != nil {
+		return false, err
+	}
+	if err := n.safe(r); err != nil {
+		return false, err
+	}
+	if err := n.reset(ctx, r, remote.Hash()); err != nil {
+		return false, err
+	}
+	if head.Hash() == remote.Hash() {
+		return false, nil
+	}
+	if err := n.chown(); err != nil {
+		return false, err
+	}
+
+	changed, err := n.changed(r, head.Hash(), remote.Hash())
+	if err != nil {
+		return false, err
+	}
+	return OfInterest(changed, names), nil
+}
+
+func (n *Native) reset(ctx context.Context, r *gogit.Repository, hash plumbing.Hash) error {
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	return n.do(ctx, "reset", func() error { return w.Reset(&gogit.ResetOptions{Commit: hash, Mode: gogit.HardReset}) })
+}
+
+// changed returns the paths that differ between commit from and commit to.
+func (n *Native) changed(r *gogit.Repository, from, to plumbing.Hash) ([]string, error) {
+	c1, err := r.CommitObject(from)
+	if err != nil {
+		return nil, err
+	}
+	c2, err := r.CommitObject(to)
+	if err != nil {
+		return nil, err
+	}
+	t1, err := c1.Tree()
+	if err != nil {
+		return nil, err
+	}
+	t2, err := c2.Tree()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := t1.Diff(t2)
+	if err != nil {
+		return nil, err
+	}
+	changed := []string{}
+	for _, c := range changes {
+		if c.From.Name != "" {
+			changed = append(changed, c.From.Name)
+		}
+		if c.To.Name != "" && c.To.Name != c.From.Name {
+			changed = append(changed, c.To.Name)
+		}
+	}
+	return changed, nil
+}
+
+// Hash returns the git hash of HEAD in the repo in n.dir. Empty string is returned in case of an error.
+// The hash is always truncated to 8 hex digits.
+func (n *Native) Hash() string {
+	r, err := gogit.PlainOpen(n.dir)
+	if err != nil {
+		return ""
+	}
+	head, err := r.Head()
+	if err != nil {
+		return ""
+	}
+	return head.Hash().String()[:8]
+}
+
+// Rollback checks out commit <hash>, and return nil if no errors are encountered.
+func (n *Native) Rollback(ctx context.Context, hash string) error {
+	r, err := gogit.PlainOpen(n.dir)
+	if err != nil {
+		return err
+	}
+	h, err := r.ResolveRevision(plumbing.Revision(hash))
+	if err != nil {
+		return err
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return err
+	}
+	if err := n.safe(r); err != nil {
+		return err
+	}
+	if err := n.do(ctx, "checkout", func() error { return w.Checkout(&gogit.CheckoutOptions{Hash: *h, Force: true}) }); err != nil {
+		return err
+	}
+	if head.Hash() == *h {
+		return nil
+	}
+	return n.chown()
+}
+
+// Branch checks out branch br. If there is no local branch br, it's fetched from upstream and created as a
+// branch tracking it, like git checkout does.
+func (n *Native) Branch(ctx context.Context, br string) error {
+	r, err := gogit.PlainOpen(n.dir)
+	if err != nil {
+		return err
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return err
+	}
+	opts := &gogit.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(br), Force: true}
+	if _, err := r.Reference(opts.Branch, true); err != nil {
+		hash, err := n.fetchBranch(ctx, r, br)
+		if err != nil {
+			return err
+		}
+		opts.Hash, opts.Create = hash, true
+	}
+	if err := n.safe(r); err != nil {
+		return err
+	}
+	if err := n.do(ctx, "checkout", func() error { return w.Checkout(opts) }); err != nil {
+		return err
+	}
+	if opts.Create {
+		err := r.CreateBranch(&config.Branch{Name: br, Remote: "origin", Merge: opts.Branch})
+		if err != nil && !errors.Is(err, gogit.ErrBranchExists) {
+			return err
+		}
+	}
+	if now, err := r.Head(); err == nil && now.Hash() == head.Hash() {
+		return nil
+	}
+	return n.chown()
+}
+
+// fetchBranch fetches branch br from upstream and returns the hash it points to. The clone is single branch, so
+// other branches are only there after they are fetched.
+func (n *Native) fetchBranch(ctx context.Context, r *gogit.Repository, br string) (plumbing.Hash, error) {
+	auth, err := sshAuth(n.upstream, n.key, n.knownhosts)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	refspec := config.RefSpec(fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%[1]s", br))
+	err = n.do(ctx, "fetch", func() error {
+		err := r.Fetch(&gogit.FetchOptions{RemoteName: "origin", RefSpecs: []config.RefSpec{refspec}, Depth: 1, Force: true, Auth: auth})
+		if errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	remote, err := r.Reference(plumbing.NewRemoteReferenceName("origin", br), true)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return remote.Hash(), nil
+}
+
+func (n *Native) RemoveAll() error { err := os.RemoveAll(n.dir); return err }
+
+// chown sets the owner of everything in n.dir to n.user, if we are root.
+func (n *Native) chown() error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	uid, gid := osutil.User(n.user)
+	return filepath.WalkDir(n.dir, func(p string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, int(uid), int(gid))
+	})
+}
+
+// safe returns an error if n.dir has something that makes root write outside of it: a symbolic link that isn't
+// in the commit HEAD points to (with the same target), or is in .git, a file with more than one link, or an entry
+// not owned by n.user or root. Nothing is checked if we aren't root.
+func (n *Native) safe(r *gogit.Repository) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	head, err := r.Head()
+	if err != nil {
+		return err
+	}
+	c, err := r.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return err
+	}
+	uid, _ := osutil.User(n.user)
+	return filepath.WalkDir(n.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("can not get the owner of %q", p)
+		}
+		if st.Uid != uid && st.Uid != 0 {
+			return fmt.Errorf("%q is owned by uid %d, not by %s or root", p, st.Uid, n.user)
+		}
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			if !committedLink(tree, n.dir, p) {
+				return fmt.Errorf("symbolic link %q is not in the repository", p)
+			}
+		case info.Mode().IsRegular() && st.Nlink > 1:
+			return fmt.Errorf("%q has %d links", p, st.Nlink)
+		}
+		return nil
+	})
+}
+
+// committedLink returns true if the symbolic link p in the worktree in dir is in tree, with the same target.
+func committedLink(tree *object.Tree, dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil || rel == "." || rel == ".git" || strings.HasPrefix(rel, ".git"+string(filepath.Separator)) {
+		return false
+	}
+	f, err := tree.File(filepath.ToSlash(rel))
+	if err != nil || f.Mode != filemode.Symlink {
+		return false
+	}
+	target, err := f.Contents()
+	if err != nil {
+		return false
+	}
+	link, err := os.Readlink(p)
+	return err == nil && link == target
+}
+
+// nativeErr wraps err in ErrAuth or ErrNetwork if applicable.
+func nativeErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := osutil.Redact(err.Error())
+	if errors.Is(err, transport.ErrAuthenticationRequired) || errors.Is(err, transport.ErrAuthorizationFailed) {
+		return fmt.Errorf("%w: %s", ErrAuth, msg)
+	}
+	var neterr net.Error
+	if errors.As(err, &neterr) {
+		return fmt.Errorf("%w: %s", ErrNetwork, msg)
+	}
+	for _, s := range []string{"connection refused", "no such host", "i/o timeout", "network is unreachable"} {
+		if strings.Contains(strings.ToLower(msg), s) {
+			return fmt.Errorf("%w: %s", ErrNetwork, msg)
+		}
+	}
+	return errors.New(msg)
+}
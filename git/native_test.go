@@ -0,0 +1,161 @@
+package git
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// commit writes file in the repository in dir and commits it.
+func commit(t *testing.T, r *gogit.Repository, dir, file string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, file)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, file), []byte(time.Now().String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Add(file); err != nil {
+		t.Fatal(err)
+	}
+	sig := &object.Signature{Name: "pgo", Email: "pgo@example.org", When: time.Now()}
+	if _, err := w.Commit("update "+file, &gogit.CommitOptions{Author: sig}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNativePull(t *testing.T) {
+	upstream := t.TempDir()
+	r, err := gogit.PlainInitWithOptions(upstream, &gogit.PlainInitOptions{
+		InitOptions: gogit.InitOptions{DefaultBranch: plumbing.NewBranchReferenceName("main")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit(t, r, upstream, "compose.yaml")
+
+	n := NewNative("test", upstream, "", "main", filepath.Join(t.TempDir(), "test"), "", "")
+	if err := n.Checkout(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	hash := n.Hash()
+	if len(hash) != 8 {
+		t.Fatalf("expected 8 digit hash, got %q", hash)
+	}
+
+	changed, err := n.Pull(context.Background(), []string{"compose.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Fatal("expected no changes, got some")
+	}
+
+	commit(t, r, upstream, "config/site.conf")
+	changed, err = n.Pull(context.Background(), []string{"compose.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Fatal("expected no changes of interest, got some")
+	}
+	if n.Hash() == hash {
+		t.Fatalf("expected hash to be updated from %q", hash)
+	}
+
+	commit(t, r, upstream, "config/site.conf")
+	changed, err = n.Pull(context.Background(), []string{"compose.yaml", "config/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("expected changes of interest, got none")
+	}
+}
+
+func TestNativeBranch(t *testing.T) {
+	upstream := t.TempDir()
+	r, err := gogit.PlainInitWithOptions(upstream, &gogit.PlainInitOptions{
+		InitOptions: gogit.InitOptions{DefaultBranch: plumbing.NewBranchReferenceName("main")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit(t, r, upstream, "compose.yaml")
+	w, _ := r.Worktree()
+	if err := w.Checkout(&gogit.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("other"), Create: true}); err != nil {
+		t.Fatal(err)
+	}
+	commit(t, r, upstream, "other.yaml")
+
+	n := NewNative("test", upstream, "", "main", filepath.Join(t.TempDir(), "test"), "", "")
+	if err := n.Checkout(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the clone is single branch, other must be fetched
+	if err := n.Branch(context.Background(), "other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(n.dir, "other.yaml")); err != nil {
+		t.Errorf("expected branch other to be checked out: %s", err)
+	}
+	if err := n.Branch(context.Background(), "main"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(n.dir, "other.yaml")); err == nil {
+		t.Errorf("expected branch main to be checked out")
+	}
+}
+
+func TestNativeSafe(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("need to be root")
+	}
+	upstream := t.TempDir()
+	r, err := gogit.PlainInitWithOptions(upstream, &gogit.PlainInitOptions{
+		InitOptions: gogit.InitOptions{DefaultBranch: plumbing.NewBranchReferenceName("main")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit(t, r, upstream, "compose.yaml")
+	os.Symlink("compose.yaml", filepath.Join(upstream, "link.yaml"))
+	w, _ := r.Worktree()
+	w.Add("link.yaml")
+	commit(t, r, upstream, "compose.yaml")
+
+	n := NewNative("test", upstream, "", "main", filepath.Join(t.TempDir(), "test"), "", "")
+	if err := n.Checkout(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Pull(context.Background(), nil); err != nil {
+		t.Fatalf("expected a committed symbolic link to be allowed, got %s", err)
+	}
+
+	for _, p := range []string{"config", ".git/planted"} {
+		link := filepath.Join(n.dir, p)
+		if err := os.Symlink(t.TempDir(), link); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := n.Pull(context.Background(), nil); err == nil {
+			t.Errorf("expected error for planted symbolic link %q, got none", p)
+		}
+		os.Remove(link)
+	}
+	if err := os.Link(filepath.Join(n.dir, "compose.yaml"), filepath.Join(n.dir, "hard.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Pull(context.Background(), nil); err == nil {
+		t.Error("expected error for hard link, got none")
+	}
+}
@@ -0,0 +1,63 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/pgo/osutil"
+)
+
+// Repo is a git repository that is tracked by pgod. Git is the implementation that uses the git binary, Native
+// is a pure Go one and Fake is an in-memory one for testing. The ctx given to the methods carries the span the
+// git commands are traced under, see tracing.Command.
+type Repo interface {
+	// IsCheckedOut returns true when the repository has been cloned.
+	IsCheckedOut() bool
+	// Checkout does the initial clone of the repository.
+	Checkout(ctx context.Context) error
+	// Pull pulls from upstream. If the returned bool is true there were updates in files matching one of the
+	// globs in names, see OfInterest.
+	Pull(ctx context.Context, names []string) (bool, error)
+	// Hash returns the git hash of HEAD, truncated to 8 hex digits, or the empty string on error.
+	Hash() string
+	// Rollback checks out commit hash.
+	Rollback(ctx context.Context, hash string) error
+	// Branch checks out branch br.
+	Branch(ctx context.Context, br string) error
+	// RemoveAll removes the local repository.
+	RemoveAll() error
+}
+
+var (
+	// ErrNetwork is returned (wrapped) when upstream could not be reached.
+	ErrNetwork = errors.New("network failure")
+	// ErrAuth is returned (wrapped) when upstream refused our credentials.
+	ErrAuth = errors.New("authentication failure")
+)
+
+// IsTransient returns true if err is a network or authentication error. These are usually resolved by trying
+// again later, and not by removing the repository and cloning it again.
+func IsTransient(err error) bool { return errors.Is(err, ErrNetwork) || errors.Is(err, ErrAuth) }
+
+// classify looks at the output of a failed git command and wraps err in ErrAuth or ErrNetwork when the output
+// says so.
+func classify(out []byte, err error) error {
+	if err == nil {
+		return nil
+	}
+	out = []byte(osutil.Redact(string(out)))
+	msg := strings.ToLower(string(out))
+	for _, s := range []string{"authentication failed", "access denied", "permission denied (publickey", "could not read username", "returned error: 401", "returned error: 403"} {
+		if strings.Contains(msg, s) {
+			return fmt.Errorf("%w: %s", ErrAuth, strings.TrimSpace(string(out)))
+		}
+	}
+	for _, s := range []string{"unable to access", "could not resolve host", "connection refused", "connection timed out", "network is unreachable"} {
+		if strings.Contains(msg, s) {
+			return fmt.Errorf("%w: %s", ErrNetwork, strings.TrimSpace(string(out)))
+		}
+	}
+	return err
+}
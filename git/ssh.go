@@ -0,0 +1,41 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// sshCommand returns the command for GIT_SSH_COMMAND that only uses key and only trusts the hosts in knownhosts.
+// Any ssh configuration of the user is ignored.
+func sshCommand(key, knownhosts string) string {
+	return fmt.Sprintf("ssh -F /dev/null -i %s -o IdentitiesOnly=yes -o StrictHostKeyChecking=yes -o UserKnownHostsFile=%s -o GlobalKnownHostsFile=/dev/null",
+		quote(key), quote(knownhosts))
+}
+
+// quote single quotes s for use in a shell command.
+func quote(s string) string { return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'" }
+
+// sshAuth returns the go-git ssh authentication for key, with knownhosts as the only known_hosts file. If
+// key is empty, nil is returned.
+func sshAuth(upstream, key, knownhosts string) (transport.AuthMethod, error) {
+	if key == "" {
+		return nil, nil
+	}
+	user := gitssh.DefaultUsername
+	if ep, err := transport.NewEndpoint(upstream); err == nil && ep.User != "" {
+		user = ep.User
+	}
+	auth, err := gitssh.NewPublicKeysFromFile(user, key, "")
+	if err != nil {
+		return nil, err
+	}
+	callback, err := gitssh.NewKnownHostsCallback(knownhosts)
+	if err != nil {
+		return nil, err
+	}
+	auth.HostKeyCallback = callback
+	return auth, nil
+}
@@ -0,0 +1,254 @@
+// Package logfile writes structured (JSON or logfmt) logs per service to files that are rotated on size. Each
+// entry carries the service, the git hash the service is on (see SetHash) and the operation.
+package logfile
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/pgo/osutil"
+)
+
+// Formats of the log files.
+const (
+	JSON   = "json"
+	Logfmt = "logfmt"
+)
+
+var (
+	// Format is the format of the log files opened by Register, JSON or Logfmt.
+	Format = JSON
+	// MaxSize is the size in bytes after which a log file is rotated.
+	MaxSize int64 = 10 << 20
+	// Keep is the number of rotated log files that are kept: file.1 up to file.<Keep>.
+	Keep = 3
+)
+
+const (
+	maxOutput = 64 << 10 // the output of a failed command is truncated to its last maxOutput bytes
+	maxLine   = 1 << 20  // longer lines are skipped by Tail
+)
+
+// File is a log file that is rotated when it grows beyond MaxSize.
+type File struct {
+	mu   sync.Mutex
+	name string
+	f    *os.File
+	size int64
+}
+
+// Open opens (or creates) the log file name for appending. The file is only accessible by its owner.
+func Open(name string) (*File, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &File{name: name, f: f, size: info.Size()}, nil
+}
+
+// Write writes p to the file, it first rotates the file if p would make it grow beyond MaxSize.
+func (l *File) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && l.size+int64(len(p)) > MaxSize {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// Close closes the file.
+func (l *File) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// rotate renames file.<n> to file.<n+1>, dropping the oldest one, and file to file.1 and opens a new file.
+func (l *File) rotate() error {
+	l.f.Close()
+	os.Remove(rotated(l.name, Keep))
+	for i := Keep - 1; i >= 1; i-- {
+		os.Rename(rotated(l.name, i), rotated(l.name, i+1))
+	}
+	if Keep > 0 {
+		os.Rename(l.name, rotated(l.name, 1))
+	}
+	f, err := os.OpenFile(l.name, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	l.f, l.size = f, 0
+	return nil
+}
+
+func rotated(name string, i int) string { return name + "." + strconv.Itoa(i) }
+
+// Remove removes the log file name and its rotated files.
+func Remove(name string) {
+	os.Remove(name)
+	for i := 1; i <= Keep; i++ {
+		os.Remove(rotated(name, i))
+	}
+}
+
+// Tail returns the last n lines of the log file name, including its rotated files. Lines longer than 1 MiB are
+// skipped.
+func Tail(name string, n int) ([]byte, error) {
+	lines := [][]byte{}
+	for i := Keep; i >= 0; i-- {
+		file := name
+		if i > 0 {
+			file = rotated(name, i)
+		}
+		f, err := os.Open(file)
+		if os.IsNotExist(err) && i > 0 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = readLines(f, func(l []byte) {
+			lines = append(lines, append([]byte{}, l...))
+			if len(lines) > n {
+				lines = lines[1:]
+			}
+		})
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	buf := &bytes.Buffer{}
+	for _, l := range lines {
+		buf.Write(l)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// readLines calls fn for each line in r, without the newline. Lines longer than maxLine are skipped.
+func readLines(r io.Reader, fn func([]byte)) error {
+	br := bufio.NewReaderSize(r, maxLine)
+	for {
+		l, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			for err == bufio.ErrBufferFull {
+				_, err = br.ReadSlice('\n')
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if len(l) > 0 {
+			fn(bytes.TrimSuffix(l, []byte{'\n'}))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type state struct {
+	file   *File
+	logger *slog.Logger
+	hash   string
+}
+
+var (
+	mu       sync.RWMutex
+	services = map[string]*state{}
+	discard  = slog.New(slog.NewTextHandler(io.Discard, nil))
+)
+
+// Register opens the log file name for service, entries are written in Format. If service already has a log
+// file, that one is closed.
+func Register(service, name string) error {
+	f, err := Open(name)
+	if err != nil {
+		return err
+	}
+	var h slog.Handler
+	switch Format {
+	case JSON, "":
+		h = slog.NewJSONHandler(f, nil)
+	case Logfmt:
+		h = slog.NewTextHandler(f, nil)
+	default:
+		f.Close()
+		return fmt.Errorf("unknown log format %q", Format)
+	}
+	Unregister(service)
+	mu.Lock()
+	defer mu.Unlock()
+	services[service] = &state{file: f, logger: slog.New(h).With("service", service)}
+	return nil
+}
+
+// Unregister closes the log file of service.
+func Unregister(service string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if s, ok := services[service]; ok {
+		s.file.Close()
+		delete(services, service)
+	}
+}
+
+// SetHash sets the git hash service is on, it is added to all entries logged for service from now on.
+func SetHash(service, hash string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if s, ok := services[service]; ok {
+		s.hash = hash
+	}
+}
+
+// Logger returns the logger of service, all its entries have an "op" attribute with the operation op. If service
+// has no log file, entries are discarded.
+func Logger(service, op string) *slog.Logger {
+	mu.RLock()
+	defer mu.RUnlock()
+	s, ok := services[service]
+	if !ok {
+		return discard
+	}
+	return s.logger.With("hash", s.hash, "op", op)
+}
+
+// Command logs the (git or compose) command op, run for service, that started at start and returned out and err.
+// The output is only logged when the command failed, and then only the last 64 KiB of it.
+func Command(service, op string, start time.Time, out []byte, err error) {
+	l := Logger(service, op)
+	if err == nil {
+		l.Info("command succeeded", "duration", time.Since(start), "exit_status", 0)
+		return
+	}
+	if len(out) > maxOutput {
+		out = append([]byte("[truncated] "), out[len(out)-maxOutput:]...)
+	}
+	l.Error("command failed", "duration", time.Since(start), "exit_status", osutil.ExitStatus(err),
+		"error", osutil.Redact(err.Error()), "output", osutil.Redact(string(out)))
+}
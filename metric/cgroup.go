@@ -0,0 +1,117 @@
+package metric
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cgroups exports the resource usage of the services' cgroups, it reads the cgroup files on each scrape.
+var cgroups = &cgroupCollector{dirs: map[string]string{}}
+
+func init() { prometheus.MustRegister(cgroups) }
+
+var (
+	cgroupCPU = prometheus.NewDesc("pgo_cgroup_cpu_seconds_total",
+		"CPU time used by the containers of a service.", []string{"service"}, nil)
+	cgroupMemory = prometheus.NewDesc("pgo_cgroup_memory_bytes",
+		"Memory used by the containers of a service.", []string{"service"}, nil)
+	cgroupMemoryMax = prometheus.NewDesc("pgo_cgroup_memory_max_bytes",
+		"Memory limit for the containers of a service.", []string{"service"}, nil)
+	cgroupIORead = prometheus.NewDesc("pgo_cgroup_io_read_bytes_total",
+		"Bytes read from block devices by the containers of a service.", []string{"service"}, nil)
+	cgroupIOWrite = prometheus.NewDesc("pgo_cgroup_io_write_bytes_total",
+		"Bytes written to block devices by the containers of a service.", []string{"service"}, nil)
+)
+
+// RegisterCgroup exports the resource usage of the cgroup directory dir for service.
+func RegisterCgroup(service, dir string) {
+	cgroups.Lock()
+	defer cgroups.Unlock()
+	cgroups.dirs[service] = dir
+}
+
+// UnregisterCgroup stops exporting the resource usage for service.
+func UnregisterCgroup(service string) {
+	cgroups.Lock()
+	defer cgroups.Unlock()
+	delete(cgroups.dirs, service)
+}
+
+type cgroupCollector struct {
+	sync.Mutex
+	dirs map[string]string // service -> cgroup directory
+}
+
+func (c *cgroupCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cgroupCPU
+	ch <- cgroupMemory
+	ch <- cgroupMemoryMax
+	ch <- cgroupIORead
+	ch <- cgroupIOWrite
+}
+
+func (c *cgroupCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+	for service, dir := range c.dirs {
+		if usec, ok := keyed(filepath.Join(dir, "cpu.stat"))["usage_usec"]; ok {
+			ch <- prometheus.MustNewConstMetric(cgroupCPU, prometheus.CounterValue, usec/1e6, service)
+		}
+		if b, ok := single(filepath.Join(dir, "memory.current")); ok {
+			ch <- prometheus.MustNewConstMetric(cgroupMemory, prometheus.GaugeValue, b, service)
+		}
+		if b, ok := single(filepath.Join(dir, "memory.max")); ok { // "max" when there is no limit
+			ch <- prometheus.MustNewConstMetric(cgroupMemoryMax, prometheus.GaugeValue, b, service)
+		}
+		io := keyed(filepath.Join(dir, "io.stat"))
+		ch <- prometheus.MustNewConstMetric(cgroupIORead, prometheus.CounterValue, io["rbytes"], service)
+		ch <- prometheus.MustNewConstMetric(cgroupIOWrite, prometheus.CounterValue, io["wbytes"], service)
+	}
+}
+
+// single reads a cgroup file holding a single number.
+func single(file string) (float64, bool) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(buf)), 64)
+	return v, err == nil
+}
+
+// keyed reads a cgroup file with "key value" lines (cpu.stat) or "device key=value ..." lines (io.stat), values
+// of the same key are summed.
+func keyed(file string) map[string]float64 {
+	m := map[string]float64{}
+	f, err := os.Open(file)
+	if err != nil {
+		return m
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && !strings.Contains(fields[1], "=") {
+			if v, err := strconv.ParseFloat(fields[1], 64); err == nil {
+				m[fields[0]] += v
+			}
+			continue
+		}
+		for _, kv := range fields {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				continue
+			}
+			if v1, err := strconv.ParseFloat(v, 64); err == nil {
+				m[k] += v1
+			}
+		}
+	}
+	return m
+}
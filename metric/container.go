@@ -0,0 +1,151 @@
+package metric
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ContainerStats is the resource usage and state of a container, as exported by the container collector.
+type ContainerStats struct {
+	Name         string // container name
+	CPUSeconds   float64
+	MemoryBytes  float64
+	NetRxBytes   float64
+	NetTxBytes   float64
+	BlockRead    float64 // bytes
+	BlockWrite   float64 // bytes
+	RestartCount int
+	Health       string // starting, healthy, unhealthy or empty if there is no health check
+}
+
+// containers exports the resource usage of the containers of each service. The registered functions are called
+// every SampleInterval in the background, a scrape gets the last sample, so it doesn't wait for docker.
+var containers = &containerCollector{samplers: map[string]*sampler{}}
+
+// SampleInterval is the interval with which the resource usage of the containers is sampled.
+var SampleInterval = 15 * time.Second
+
+func init() { prometheus.MustRegister(containers) }
+
+var (
+	containerLabels = []string{"service", "container"}
+
+	containerCPU = prometheus.NewDesc("pgo_container_cpu_seconds_total",
+		"CPU time used by a container.", containerLabels, nil)
+	containerMemory = prometheus.NewDesc("pgo_container_memory_bytes",
+		"Memory used by a container, without reclaimable page cache.", containerLabels, nil)
+	containerNetRx = prometheus.NewDesc("pgo_container_network_receive_bytes_total",
+		"Bytes received by a container.", containerLabels, nil)
+	containerNetTx = prometheus.NewDesc("pgo_container_network_transmit_bytes_total",
+		"Bytes transmitted by a container.", containerLabels, nil)
+	containerBlockRead = prometheus.NewDesc("pgo_container_blkio_read_bytes_total",
+		"Bytes read from block devices by a container.", containerLabels, nil)
+	containerBlockWrite = prometheus.NewDesc("pgo_container_blkio_write_bytes_total",
+		"Bytes written to block devices by a container.", containerLabels, nil)
+	containerRestarts = prometheus.NewDesc("pgo_container_restart_count",
+		"Number of times docker restarted a container.", containerLabels, nil)
+	containerHealthy = prometheus.NewDesc("pgo_container_healthy",
+		"1 if a container's health check passes, 0 otherwise. Only for containers with a health check.", containerLabels, nil)
+)
+
+// RegisterContainers exports the resource usage of the containers returned by stats, under service.
+func RegisterContainers(service string, stats func() ([]ContainerStats, error)) {
+	s := &sampler{stats: stats, stop: make(chan struct{})}
+	containers.Lock()
+	defer containers.Unlock()
+	if old, ok := containers.samplers[service]; ok {
+		close(old.stop)
+	}
+	containers.samplers[service] = s
+	go s.run()
+}
+
+// UnregisterContainers stops exporting the resource usage of the containers of service.
+func UnregisterContainers(service string) {
+	containers.Lock()
+	defer containers.Unlock()
+	if s, ok := containers.samplers[service]; ok {
+		close(s.stop)
+		delete(containers.samplers, service)
+	}
+}
+
+type containerCollector struct {
+	sync.Mutex
+	samplers map[string]*sampler // service -> sampler of its containers
+}
+
+// sampler samples the stats of the containers of a service until stop is closed.
+type sampler struct {
+	stats func() ([]ContainerStats, error)
+	stop  chan struct{}
+
+	mu   sync.Mutex
+	last []ContainerStats // last sample, nil if it failed
+}
+
+func (s *sampler) run() {
+	for {
+		cs, err := s.stats()
+		if err != nil {
+			cs = nil
+		}
+		s.mu.Lock()
+		s.last = cs
+		s.mu.Unlock()
+
+		select {
+		case <-time.After(SampleInterval):
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *sampler) sample() []ContainerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+func (c *containerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- containerCPU
+	ch <- containerMemory
+	ch <- containerNetRx
+	ch <- containerNetTx
+	ch <- containerBlockRead
+	ch <- containerBlockWrite
+	ch <- containerRestarts
+	ch <- containerHealthy
+}
+
+func (c *containerCollector) Collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+	for service, sampler := range c.samplers {
+		for _, s := range sampler.sample() {
+			counter := func(d *prometheus.Desc, v float64) {
+				ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, v, service, s.Name)
+			}
+			gauge := func(d *prometheus.Desc, v float64) {
+				ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, service, s.Name)
+			}
+			counter(containerCPU, s.CPUSeconds)
+			gauge(containerMemory, s.MemoryBytes)
+			counter(containerNetRx, s.NetRxBytes)
+			counter(containerNetTx, s.NetTxBytes)
+			counter(containerBlockRead, s.BlockRead)
+			counter(containerBlockWrite, s.BlockWrite)
+			gauge(containerRestarts, float64(s.RestartCount))
+			if s.Health != "" {
+				healthy := 0.0
+				if s.Health == "healthy" {
+					healthy = 1
+				}
+				gauge(containerHealthy, healthy)
+			}
+		}
+	}
+}
@@ -19,4 +19,128 @@ var (
 		Name:      "error_count",
 		Help:      "Counter for the number of commands executed that resulted in an error",
 	}, []string{"service", "cmd", "subcmd"})
+
+	DeployDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "pgo",
+		Subsystem: "deploy",
+		Name:      "duration_seconds",
+		Help:      "Histogram of the time it takes to (re)deploy a service.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10), // 1s to ~8.5m
+	}, []string{"service"})
+
+	DeployTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pgo",
+		Subsystem: "deploy",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful deploy of a service.",
+	}, []string{"service"})
+
+	PullTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pgo",
+		Subsystem: "git",
+		Name:      "last_pull_success_timestamp_seconds",
+		Help:      "Unix time of the last successful git pull of a service.",
+	}, []string{"service"})
+
+	GitInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pgo",
+		Subsystem: "git",
+		Name:      "info",
+		Help:      "The git hash a service is on, the value is always 1.",
+	}, []string{"service", "hash"})
+
+	ForcedDown = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pgo",
+		Subsystem: "service",
+		Name:      "forced_down",
+		Help:      "1 if a service is forced down with a stop file, 0 otherwise.",
+	}, []string{"service"})
+
+	PolicyViolationCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pgo",
+		Subsystem: "policy",
+		Name:      "violation_count",
+		Help:      "Counter for the number of times a compose file was found to violate a rule.",
+	}, []string{"service", "rule"})
+
+	Containers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pgo",
+		Subsystem: "service",
+		Name:      "containers",
+		Help:      "Number of containers of a service per state.",
+	}, []string{"service", "state"})
+)
+
+var (
+	ContainerEventCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pgo",
+		Subsystem: "container",
+		Name:      "event_count",
+		Help:      "Counter for the number of die, oom, restart and health_status docker events of a service's containers.",
+	}, []string{"service", "event"})
+
+	CrashLooping = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pgo",
+		Subsystem: "service",
+		Name:      "crash_looping",
+		Help:      "1 if the containers of a service keep dying, 0 otherwise.",
+	}, []string{"service"})
+
+	RemediationCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pgo",
+		Subsystem: "service",
+		Name:      "remediation_count",
+		Help:      "Counter for the number of automatic remediations (up or restart) of a service's containers.",
+	}, []string{"service", "action"})
+
+	ProbeSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pgo",
+		Subsystem: "probe",
+		Name:      "success",
+		Help:      "1 if the last probe of a URL of a service succeeded, 0 otherwise.",
+	}, []string{"service", "url"})
+
+	ProbeStatus = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pgo",
+		Subsystem: "probe",
+		Name:      "status_code",
+		Help:      "HTTP status code of the last probe of a URL of a service, 0 if there was no response.",
+	}, []string{"service", "url"})
+
+	ProbeDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pgo",
+		Subsystem: "probe",
+		Name:      "duration_seconds",
+		Help:      "Duration of the last probe of a URL of a service.",
+	}, []string{"service", "url"})
+
+	ProbeCertExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pgo",
+		Subsystem: "probe",
+		Name:      "cert_expiry_timestamp_seconds",
+		Help:      "Unix time the TLS certificate of a URL of a service expires.",
+	}, []string{"service", "url"})
 )
+
+// States are the container states as reported by docker.
+var States = []string{"created", "running", "paused", "restarting", "removing", "exited", "dead"}
+
+// SetGitHash sets the git info metric of service to hash, removing the previous hash.
+func SetGitHash(service, hash string) {
+	GitInfo.DeletePartialMatch(prometheus.Labels{"service": service})
+	GitInfo.WithLabelValues(service, hash).Set(1)
+}
+
+// DeleteProbes removes the probe metrics of all URLs of service.
+func DeleteProbes(service string) {
+	for _, g := range []*prometheus.GaugeVec{ProbeSuccess, ProbeStatus, ProbeDuration, ProbeCertExpiry} {
+		g.DeletePartialMatch(prometheus.Labels{"service": service})
+	}
+}
+
+// SetContainers sets the number of containers of service per state, states not in count are set to 0.
+func SetContainers(service string, count map[string]int) {
+	for _, s := range States {
+		Containers.WithLabelValues(service, s).Set(float64(count[s]))
+	}
+}
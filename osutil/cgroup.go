@@ -0,0 +1,98 @@
+package osutil
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// CgroupRoot is where the cgroup v2 hierarchy is mounted.
+const CgroupRoot = "/sys/fs/cgroup"
+
+// unitDir is where runtime systemd units are written.
+const unitDir = "/run/systemd/system"
+
+// Slice creates, or updates, and starts the systemd slice (i.e. "pgo-caddy.slice") with properties, these are
+// in systemd.resource-control(5) syntax, i.e. "MemoryMax=512M". The unit is written to /run, so it doesn't
+// survive a reboot.
+func Slice(slice string, properties []string) error {
+	unit := "[Unit]\nDescription=pgo slice " + slice + "\n\n[Slice]\n" + strings.Join(properties, "\n") + "\n"
+	file := filepath.Join(unitDir, slice)
+	if old, err := os.ReadFile(file); err == nil && string(old) == unit {
+		return systemctl("start", slice)
+	}
+	if err := os.WriteFile(file, []byte(unit), 0644); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	if err := systemctl("start", slice); err != nil {
+		return err
+	}
+	// apply new properties to an already running slice
+	return systemctl(append([]string{"set-property", "--runtime", slice}, properties...)...)
+}
+
+// RemoveSlice stops and removes the systemd slice, if it exists.
+func RemoveSlice(slice string) error {
+	file := filepath.Join(unitDir, slice)
+	if _, err := os.Stat(file); err != nil {
+		return nil
+	}
+	systemctl("stop", slice)
+	if err := os.Remove(file); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
+
+// SlicePath returns the cgroup directory of the systemd slice. Dashes in the name denote the slice hierarchy,
+// so "pgo-caddy.slice" lives in "pgo.slice/pgo-caddy.slice".
+func SlicePath(slice string) string {
+	name := strings.TrimSuffix(slice, ".slice")
+	parts := strings.Split(name, "-")
+	p := CgroupRoot
+	for i := range parts {
+		p = filepath.Join(p, strings.Join(parts[:i+1], "-")+".slice")
+	}
+	return p
+}
+
+// Cgroup creates, or updates, the cgroup directory name under CgroupRoot and writes the controller files,
+// i.e. "memory.max" with value "536870912". This is for hosts without systemd, or with docker using the
+// cgroupfs cgroup driver.
+func Cgroup(name string, files map[string]string) error {
+	dir := filepath.Join(CgroupRoot, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for f, v := range files {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte(v), 0644); err != nil {
+			return fmt.Errorf("writing %q to %s: %s", v, filepath.Join(dir, f), err)
+		}
+	}
+	return nil
+}
+
+// RemoveCgroup removes the cgroup directory name under CgroupRoot, if it exists. This fails if there are still
+// processes in it.
+func RemoveCgroup(name string) error {
+	err := os.Remove(filepath.Join(CgroupRoot, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func systemctl(args ...string) error {
+	ctx := context.TODO()
+	out, err := exec.CommandContext(ctx, "systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
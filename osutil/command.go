@@ -1,8 +1,11 @@
 package osutil
 
 import (
+	"errors"
 	"fmt"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"syscall"
 )
@@ -16,23 +19,85 @@ func EnvVars(env []string) []string {
 	return envnames
 }
 
-func RunAs(cmd *exec.Cmd, user string) error {
+// credentials matches the user info in URLs, i.e. "oauth2:<token>@" in "https://oauth2:<token>@example.org".
+var credentials = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/@\s]+@`)
+
+// Redact removes the user info from all URLs in s, so the credentials in them don't leak into the logs.
+func Redact(s string) string { return credentials.ReplaceAllString(s, "${1}xxxxx@") }
+
+// ExitStatus returns the exit status of a command that returned err: 0 if err is nil, the exit code if err is an
+// *exec.ExitError and -1 otherwise.
+func ExitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	exit := &exec.ExitError{}
+	if errors.As(err, &exit) {
+		return exit.ExitCode()
+	}
+	return -1
+}
+
+// Container engines.
+const (
+	Docker         = "docker"
+	DockerRootless = "docker-rootless" // docker against a per-user rootless docker daemon
+	Podman         = "podman"
+)
+
+// Binary returns the binary to execute for engine.
+func Binary(engine string) string {
+	if engine == Podman {
+		return Podman
+	}
+	return Docker
+}
+
+// RunAs sets up cmd to run as user. If engine is Docker the docker group is added to the supplementary groups
+// of user, so the docker socket can be used. If engine is Podman or DockerRootless no group is added, but
+// XDG_RUNTIME_DIR and DOCKER_HOST are set so the user's own (rootless) socket is used. Otherwise nothing extra
+// is done.
+func RunAs(cmd *exec.Cmd, user, engine string) error {
 	uid, gid := User(user)
 	if uid == 0 && gid == 0 && user != "root" {
 		return fmt.Errorf("failed to resolve user %q to uid/gid", user)
 	}
-	dgid := DockerGroup()
-	if dgid == 0 {
-		return fmt.Errorf("failed to resolve docker to gid")
-	}
 	groups := Groups(user)
-	groups = append(groups, dgid)
+	if engine == Docker {
+		dgid := DockerGroup()
+		if dgid == 0 {
+			return fmt.Errorf("failed to resolve docker to gid")
+		}
+		groups = append(groups, dgid)
+	}
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid, Groups: groups}
 
 	path := "/usr/sbin:/usr/bin:/sbin:/bin"
 	cmd.Env = []string{env("HOME", Home(user)), env("PATH", path)}
+	if engine == Podman || engine == DockerRootless {
+		if uid != 0 {
+			cmd.Env = append(cmd.Env, env("XDG_RUNTIME_DIR", runtimeDir(uid)))
+		}
+		cmd.Env = append(cmd.Env, env("DOCKER_HOST", "unix://"+Socket(user, engine)))
+	}
 	return nil
 }
 
+// Socket returns the path of the API socket of engine when used by user. For podman this is the rootless
+// socket of user, unless user is root.
+func Socket(user, engine string) string {
+	uid, _ := User(user)
+	switch engine {
+	case DockerRootless:
+		return filepath.Join(runtimeDir(uid), "docker.sock")
+	case Podman:
+		if uid == 0 {
+			return "/run/podman/podman.sock"
+		}
+		return filepath.Join(runtimeDir(uid), "podman", "podman.sock")
+	}
+	return "/var/run/docker.sock"
+}
+
 func env(k, v string) string { return k + "=" + v }
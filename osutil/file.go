@@ -0,0 +1,52 @@
+package osutil
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"syscall"
+)
+
+// OpenDir opens the directory dir, without following a symlink as its last element.
+func OpenDir(dir string) (*os.File, error) {
+	return os.OpenFile(dir, os.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+}
+
+// WriteFileAt writes data to the file name in the open directory d, with permissions perm and owned by uid and
+// gid (-1 keeps the owner). The data is written to a new temporary file that is then renamed to name. Symlinks are
+// never followed, so this is safe to do as root in a directory that is writable by another user.
+func WriteFileAt(d *os.File, name string, data []byte, perm os.FileMode, uid, gid int) error {
+	dfd := int(d.Fd())
+	tmp, fd, err := "", -1, error(nil)
+	for i := 0; i < 10; i++ {
+		tmp = fmt.Sprintf(".%s.%d", name, rand.Uint32())
+		fd, err = syscall.Openat(dfd, tmp, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0600)
+		if err != syscall.EEXIST {
+			break
+		}
+	}
+	if err != nil {
+		return &os.PathError{Op: "openat", Path: tmp, Err: err}
+	}
+
+	f := os.NewFile(uintptr(fd), tmp)
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil && uid >= 0 {
+		err = f.Chown(uid, gid)
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		if err = syscall.Renameat(dfd, tmp, dfd, name); err != nil {
+			err = &os.LinkError{Op: "renameat", Old: tmp, New: name, Err: err}
+		}
+	}
+	if err != nil {
+		syscall.Unlinkat(dfd, tmp)
+	}
+	return err
+}
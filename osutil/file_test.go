@@ -0,0 +1,44 @@
+package osutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAt(t *testing.T) {
+	dir, other := t.TempDir(), t.TempDir()
+	target := filepath.Join(other, "shadow")
+	os.WriteFile(target, []byte("secret"), 0600)
+	if err := os.Symlink(target, filepath.Join(dir, "config.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := OpenDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := WriteFileAt(d, "config.json", []byte("{}"), 0640, -1, -1); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := os.ReadFile(target); string(buf) != "secret" {
+		t.Errorf("expected symlink target to be untouched, got %q", buf)
+	}
+	info, err := os.Lstat(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm() != 0640 {
+		t.Errorf("expected regular file with mode 0640, got %s", info.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected temporary file to be gone, got %d entries", len(entries))
+	}
+
+	link := filepath.Join(t.TempDir(), "link")
+	os.Symlink(other, link)
+	if _, err := OpenDir(link); err == nil {
+		t.Error("expected error opening a symlink as directory, got none")
+	}
+}
@@ -0,0 +1,201 @@
+package osutil
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.science.ru.nl/log"
+)
+
+// RuntimeDir is the directory holding the per-user runtime directories (XDG_RUNTIME_DIR). It is a variable so
+// tests can point it elsewhere.
+var RuntimeDir = "/run/user"
+
+// daemons holds the rootless docker daemons we've started, per user.
+var daemons = struct {
+	sync.Mutex
+	m map[string]*exec.Cmd
+}{m: map[string]*exec.Cmd{}}
+
+// runtimeDir returns the XDG_RUNTIME_DIR for uid.
+func runtimeDir(uid uint32) string {
+	return filepath.Join(RuntimeDir, strconv.FormatUint(uint64(uid), 10))
+}
+
+// StartRootless starts a rootless docker daemon (dockerd-rootless.sh) for user, unless one is already running.
+// The daemon listens on Socket(user, DockerRootless). This needs the docker rootless extras to be installed
+// and subordinate uids and gids for user (see /etc/subuid and /etc/subgid). The pid of the daemon is recorded in
+// the file user in dir, so StopRootless can stop it after a restart of pgod; dir must only be writable by root.
+func StartRootless(u, dir string) error {
+	daemons.Lock()
+	socket, started, err := startRootless(u, dir)
+	daemons.Unlock()
+	if err != nil || !started {
+		return err
+	}
+
+	// The daemon is recorded in daemons, wait for it without holding the lock, so the daemons of other users
+	// can be started and stopped in the meantime.
+	for i := 0; i < 60; i++ {
+		if alive(socket) {
+			log.Infof("Rootless docker for user %q is up", u)
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("rootless docker for user %q did not come up on %q", u, socket)
+}
+
+// startRootless starts the rootless docker daemon for user and records it in daemons, it must be called with
+// daemons locked. Started is false if the daemon was already running.
+func startRootless(u, dir string) (socket string, started bool, err error) {
+	if _, ok := daemons.m[u]; ok {
+		return "", false, nil
+	}
+	socket = Socket(u, DockerRootless)
+	if alive(socket) { // started by a previous incarnation of pgod, or by the user
+		return "", false, nil
+	}
+
+	uid, gid := User(u)
+	if uid == 0 {
+		return "", false, fmt.Errorf("rootless docker can not run as root, or user %q is not found", u)
+	}
+	rdir := runtimeDir(uid)
+	if err := os.MkdirAll(rdir, 0700); err != nil {
+		return "", false, err
+	}
+	if err := os.Chown(rdir, int(uid), int(gid)); err != nil {
+		return "", false, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", false, err
+	}
+
+	cmd := exec.Command("dockerd-rootless.sh")
+	if err := RunAs(cmd, u, DockerRootless); err != nil {
+		return "", false, err
+	}
+	cmd.Dir = Home(u)
+	log.Infof("Starting rootless docker for user %q on %q", u, socket)
+	if err := cmd.Start(); err != nil {
+		return "", false, err
+	}
+	daemons.m[u] = cmd
+	marker := filepath.Join(dir, u)
+	if err := os.WriteFile(marker, []byte(strconv.Itoa(cmd.Process.Pid)), 0600); err != nil {
+		log.Warningf("Failed to mark rootless docker of user %q as ours: %s", u, err)
+	}
+
+	go func() {
+		err := cmd.Wait()
+		log.Warningf("Rootless docker for user %q exited: %v", u, err)
+		daemons.Lock()
+		os.Remove(marker)
+		delete(daemons.m, u)
+		daemons.Unlock()
+	}()
+	return socket, true, nil
+}
+
+// StopRootless stops the rootless docker daemon of user, if we started it. A daemon started by a previous
+// incarnation of pgod is found through its pid file in dir (see StartRootless), it is only signaled when that
+// process still is rootlesskit running as user.
+func StopRootless(u, dir string) error {
+	marker := filepath.Join(dir, u)
+	daemons.Lock()
+	cmd, ok := daemons.m[u]
+	daemons.Unlock()
+	if ok {
+		log.Infof("Stopping rootless docker for user %q", u)
+		// RunAs puts the daemon in its own process group, signal all of it.
+		if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			return err
+		}
+		os.Remove(marker)
+		return nil
+	}
+
+	buf, err := os.ReadFile(marker)
+	if os.IsNotExist(err) {
+		return nil // not ours
+	}
+	if err != nil {
+		return err
+	}
+	defer os.Remove(marker)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil || pid <= 1 {
+		return fmt.Errorf("bad pid in %q", marker)
+	}
+	uid, _ := User(u)
+	if uid == 0 {
+		return fmt.Errorf("user %q is not found", u)
+	}
+	if !isRootless(pid, uid) {
+		return nil // exited, the pid may have been reused
+	}
+	log.Infof("Stopping rootless docker for user %q", u)
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// isRootless returns true if process pid is rootlesskit (which dockerd-rootless.sh execs) running as uid.
+func isRootless(pid int, uid uint32) bool {
+	proc := filepath.Join("/proc", strconv.Itoa(pid))
+	info, err := os.Stat(proc)
+	if err != nil {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Uid != uid {
+		return false
+	}
+	exe, err := os.Readlink(filepath.Join(proc, "exe"))
+	if err != nil {
+		return false
+	}
+	return filepath.Base(strings.TrimSuffix(exe, " (deleted)")) == "rootlesskit"
+}
+
+// StaleRootless stops all rootless docker daemons we've started for users not in users, dir is the directory
+// given to StartRootless.
+func StaleRootless(users []string, dir string) error {
+	markers, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return err
+	}
+Markers:
+	for _, m := range markers {
+		u1 := filepath.Base(m)
+		for _, u := range users {
+			if u == u1 {
+				continue Markers
+			}
+		}
+		if err := StopRootless(u1, dir); err != nil {
+			log.Warningf("Failed to stop (stale) rootless docker for user %q: %s", u1, err)
+		}
+	}
+	return nil
+}
+
+// alive returns true if something listens on the unix socket.
+func alive(socket string) bool {
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
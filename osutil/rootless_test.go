@@ -0,0 +1,29 @@
+package osutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStopRootlessMarker(t *testing.T) {
+	if isRootless(1, 0) {
+		t.Error("expected init not to be a rootless docker daemon")
+	}
+	if isRootless(os.Getpid(), uint32(os.Getuid())) {
+		t.Error("expected the test not to be a rootless docker daemon")
+	}
+
+	dir := t.TempDir()
+	for _, pid := range []string{"1", "-1", "0", "bogus"} {
+		if err := os.WriteFile(filepath.Join(dir, "nobody"), []byte(pid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := StopRootless("nobody", dir); err == nil {
+			t.Errorf("expected error for pid %q", pid)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "nobody")); err == nil {
+			t.Errorf("expected marker with pid %q to be removed", pid)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package osutil
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// UserComment is the comment (GECOS field) of the users created by AddUser, this marks them as ours.
+const UserComment = "pgod service user"
+
+// Files holding the subordinate uid and gid ranges.
+var (
+	SubUID = "/etc/subuid"
+	SubGID = "/etc/subgid"
+)
+
+const (
+	subIDStart = 100000 // first subordinate id we hand out
+	subIDCount = 65536  // size of the subordinate id range per user
+)
+
+// AddUser creates the system user u, with its own group, home directory home and without a login shell. The user
+// also gets a range of subordinate uids and gids for rootless containers.
+func AddUser(u, home string) error {
+	if out, err := command("useradd", "--system", "--user-group", "--create-home", "--home-dir", home,
+		"--shell", "/usr/sbin/nologin", "--comment", UserComment, u); err != nil {
+		return fmt.Errorf("useradd %s: %s: %s", u, err, out)
+	}
+	start, err := nextSubID()
+	if err != nil {
+		return err
+	}
+	ids := fmt.Sprintf("%d-%d", start, start+subIDCount-1)
+	if out, err := command("usermod", "--add-subuids", ids, "--add-subgids", ids, u); err != nil {
+		return fmt.Errorf("usermod %s: %s: %s", u, err, out)
+	}
+	return nil
+}
+
+// DelUser removes the user u and its home directory, but only if it was created by AddUser.
+func DelUser(u string) error {
+	if !IsOurs(u) {
+		return fmt.Errorf("user %q is not created by us", u)
+	}
+	if out, err := command("userdel", "--remove", u); err != nil {
+		return fmt.Errorf("userdel %s: %s: %s", u, err, out)
+	}
+	return nil
+}
+
+// IsOurs returns true if the user u exists and was created by AddUser.
+func IsOurs(u string) bool {
+	u1, err := user.Lookup(u)
+	if err != nil {
+		return false
+	}
+	return u1.Name == UserComment
+}
+
+// nextSubID returns the start of the first subordinate id range that is free in both SubUID and SubGID.
+func nextSubID() (int, error) {
+	start := subIDStart
+	for _, file := range []string{SubUID, SubGID} {
+		f, err := os.Open(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		end := subIDEnd(f)
+		f.Close()
+		if end > start {
+			start = end
+		}
+	}
+	return start, nil
+}
+
+// subIDEnd returns the first id after all the ranges in r, which is in subuid(5) format: "user:start:count".
+func subIDEnd(r io.Reader) int {
+	end := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 {
+			continue
+		}
+		start, err1 := strconv.Atoi(fields[1])
+		count, err2 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if start+count > end {
+			end = start + count
+		}
+	}
+	return end
+}
+
+func command(name string, args ...string) (string, error) {
+	ctx := context.TODO()
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	return strings.TrimSpace(string(out)), err
+}
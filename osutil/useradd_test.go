@@ -0,0 +1,21 @@
+package osutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSubIDEnd(t *testing.T) {
+	const subuid = `miek:100000:65536
+# comment
+bliep:165536:65536
+bad:line
+bloep:231072:1000
+`
+	if end := subIDEnd(strings.NewReader(subuid)); end != 232072 {
+		t.Errorf("expected end %d, got %d", 232072, end)
+	}
+	if end := subIDEnd(strings.NewReader("")); end != 0 {
+		t.Errorf("expected end %d, got %d", 0, end)
+	}
+}
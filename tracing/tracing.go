@@ -0,0 +1,82 @@
+// Package tracing exports OpenTelemetry traces of the deploy pipeline to an OTLP collector. Each Track iteration
+// of a service is a span, the git and compose commands run for that iteration are its children. SSH routes and
+// remediations get their own span, with the commands they run as children. The spans are passed along in a
+// context.Context.
+package tracing
+
+import (
+	"context"
+
+	"github.com/miekg/pgo/osutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attributes set on the spans.
+const (
+	Service    = attribute.Key("pgo.service")
+	Hash       = attribute.Key("pgo.hash")
+	ExitStatus = attribute.Key("pgo.exit_status")
+)
+
+const tracerName = "github.com/miekg/pgo"
+
+// Setup exports the traces to the OTLP/HTTP endpoint, i.e. "http://localhost:4318". The returned function flushes
+// and stops the exporter. If endpoint is empty nothing is exported.
+func Setup(endpoint, version string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exp, err := otlptracehttp.New(context.TODO(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("pgod"), semconv.ServiceVersion(version))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+func tracer() trace.Tracer { return otel.Tracer(tracerName) }
+
+// Begin starts the span of a Track iteration (or remediation) of service, as a child of the span in ctx if any.
+// The returned context carries the span, the commands run with it are its children, see Command.
+func Begin(ctx context.Context, service, name string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(Service.String(service)))
+}
+
+// End ends span, which was started with Begin, hash is the git hash the service is on after the iteration.
+func End(span trace.Span, hash string) {
+	span.SetAttributes(Hash.String(hash))
+	span.End()
+}
+
+// Command starts the span of a (git or compose) command run for service, as a child of the span in ctx. Finish
+// it with Exit.
+func Command(ctx context.Context, service, name string) trace.Span {
+	_, span := tracer().Start(ctx, name, trace.WithAttributes(Service.String(service)))
+	return span
+}
+
+// Route starts the span of the SSH route for service. The returned context carries the span, finish it with Exit.
+func Route(ctx context.Context, service, route string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, "route "+route, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(Service.String(service)))
+}
+
+// Exit records the exit status of err (see osutil.ExitStatus) in span and ends it.
+func Exit(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, osutil.Redact(err.Error()))
+	}
+	span.SetAttributes(ExitStatus.Int(osutil.ExitStatus(err)))
+	span.End()
+}
@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	coltrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTracing(t *testing.T) {
+	// collector stand-in that records the spans it receives
+	var (
+		mu    sync.Mutex
+		spans = map[string]*tracepb.Span{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := io.ReadAll(r.Body)
+		req := &coltrace.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(buf, req); err != nil {
+			t.Errorf("failed to unmarshal export request: %s", err)
+		}
+		mu.Lock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					spans[s.Name] = s
+				}
+			}
+		}
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		buf, _ = proto.Marshal(&coltrace.ExportTraceServiceResponse{})
+		w.Write(buf)
+	}))
+	defer srv.Close()
+
+	shutdown, err := Setup(srv.URL, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, span := Begin(context.Background(), "pgo", "track")
+	rctx, rspan := Route(context.Background(), "pgo", "ps")
+	Exit(Command(ctx, "pgo", "git pull"), nil)
+	Exit(Command(rctx, "pgo", "compose ps"), nil) // while the iteration is active
+	Exit(Command(ctx, "pgo", "compose up"), errors.New("failed"))
+	End(span, "0123abcd")
+	Exit(rspan, nil)
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	track, ok := spans["track"]
+	if !ok {
+		t.Fatalf("expected track span, got %v", spans)
+	}
+	if h := attr(track, Hash); h != "0123abcd" {
+		t.Errorf("expected hash %q, got %q", "0123abcd", h)
+	}
+	for _, name := range []string{"git pull", "compose up"} {
+		s := spans[name]
+		if s == nil || string(s.ParentSpanId) != string(track.SpanId) {
+			t.Errorf("expected %q to be a child of track", name)
+			continue
+		}
+		if x := attr(s, Service); x != "pgo" {
+			t.Errorf("expected service %q for %q, got %q", "pgo", name, x)
+		}
+	}
+	if x := attr(spans["compose up"], ExitStatus); x != "-1" {
+		t.Errorf("expected exit status -1, got %q", x)
+	}
+	if s, r := spans["compose ps"], spans["route ps"]; s == nil || r == nil || string(s.ParentSpanId) != string(r.SpanId) {
+		t.Errorf("expected compose ps to be a child of the route")
+	}
+}
+
+// attr returns the value of the attribute k of s as a string.
+func attr(s *tracepb.Span, k attribute.Key) string {
+	for _, a := range s.Attributes {
+		if a.Key != string(k) {
+			continue
+		}
+		switch v := a.Value.Value.(type) {
+		case *commonpb.AnyValue_StringValue:
+			return v.StringValue
+		case *commonpb.AnyValue_IntValue:
+			return strconv.FormatInt(v.IntValue, 10)
+		}
+	}
+	return ""
+}